@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultBagPageSize = 100
+	maxBagPageSize     = 1000
+)
+
+// bagListing is an entry of the bag listing returned to operators.
+type bagListing struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	Status     string    `json:"status"`
+}
+
+// bagListQuery contains the query parameters of a bag listing request.
+type bagListQuery struct {
+	From, To time.Time
+	SortBy   string
+	Desc     bool
+	Offset   int
+	PageSize int
+}
+
+// bagSortKeys maps the sort keys accepted in the sort parameter to functions
+// comparing bags by them.
+var bagSortKeys = map[string]func(a, b *bagListing) bool{
+	"name":       func(a, b *bagListing) bool { return a.Name < b.Name },
+	"size":       func(a, b *bagListing) bool { return a.Size < b.Size },
+	"uploadedAt": func(a, b *bagListing) bool { return a.UploadedAt.Before(b.UploadedAt) },
+}
+
+func parseQueryTime(query url.Values, key string) (time.Time, error) {
+	s := query.Get(key)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", key)
+	}
+	return t, nil
+}
+
+func parseBagListQuery(query url.Values) (q bagListQuery, err error) {
+	if q.From, err = parseQueryTime(query, "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseQueryTime(query, "to"); err != nil {
+		return q, err
+	}
+	q.SortBy = query.Get("sort")
+	if strings.HasPrefix(q.SortBy, "-") {
+		q.SortBy = q.SortBy[1:]
+		q.Desc = true
+	}
+	if q.SortBy == "" {
+		q.SortBy = "name"
+	} else if _, ok := bagSortKeys[q.SortBy]; !ok {
+		return q, fmt.Errorf("invalid sort key: %s", q.SortBy)
+	}
+	q.PageSize = defaultBagPageSize
+	if s := query.Get("pageSize"); s != "" {
+		q.PageSize, err = strconv.Atoi(s)
+		if err != nil || q.PageSize <= 0 || q.PageSize > maxBagPageSize {
+			return q, fmt.Errorf("pageSize must be between 1 and %d", maxBagPageSize)
+		}
+	}
+	// Page tokens are offsets into the sorted listing.
+	if s := query.Get("pageToken"); s != "" {
+		q.Offset, err = strconv.Atoi(s)
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("invalid pageToken")
+		}
+	}
+	return q, nil
+}
+
+// includes reports whether the bag was uploaded within the time range of the
+// query. The range includes From and excludes To.
+func (q *bagListQuery) includes(b *bagListing) bool {
+	return (q.From.IsZero() || !b.UploadedAt.Before(q.From)) &&
+		(q.To.IsZero() || b.UploadedAt.Before(q.To))
+}
+
+// bagListHandler lists the bags of a device in the storage. The status of
+// each bag is read from the catalog. Bags which are not in the catalog are
+// reported as complete.
+func bagListHandler(backend StorageBackend, catalog *bagCatalog) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		q, err := parseBagListQuery(r.URL.Query())
+		if err != nil {
+			writeErrMsg(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		objects, err := backend.List(r.Context(), vars["tenant"], vars["device"])
+		if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		statuses, err := catalog.Statuses(r.Context(), vars["tenant"], vars["device"])
+		if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		bags := make([]*bagListing, 0, len(objects))
+		for _, obj := range objects {
+			bag := &bagListing{
+				Name:       obj.Name,
+				Size:       obj.Size,
+				UploadedAt: obj.Updated.UTC(),
+				Status:     uploadStatusComplete,
+			}
+			if status, ok := statuses[obj.Name]; ok {
+				bag.Status = status
+			}
+			if q.includes(bag) {
+				bags = append(bags, bag)
+			}
+		}
+		less := bagSortKeys[q.SortBy]
+		sort.SliceStable(bags, func(i, j int) bool {
+			if q.Desc {
+				return less(bags[j], bags[i])
+			}
+			return less(bags[i], bags[j])
+		})
+		resp := jsonObj{}
+		if q.Offset >= len(bags) {
+			bags = bags[:0]
+		} else {
+			bags = bags[q.Offset:]
+		}
+		if len(bags) > q.PageSize {
+			bags = bags[:q.PageSize]
+			resp["nextPageToken"] = strconv.Itoa(q.Offset + q.PageSize)
+		}
+		resp["bags"] = bags
+		writeJSON(rw, resp)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBagListHandler(t *testing.T) {
+	catalog := testCatalog(t)
+	backend := &localBackend{Dir: t.TempDir()}
+	deviceDir := filepath.Join(backend.Dir, "tenant", "device")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	base := time.Date(2021, 3, 20, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"c.db3", "a.db3", "b.db3", ".a.db3.digests.json"} {
+		filePath := filepath.Join(deviceDir, name)
+		require.Nil(t, os.WriteFile(filePath, make([]byte, 10*(i+1)), 0o600))
+		uploaded := base.Add(time.Duration(i) * 24 * time.Hour)
+		require.Nil(t, os.Chtimes(filePath, uploaded, uploaded))
+	}
+	require.Nil(t, catalog.RecordIssued(context.Background(), &bagUpload{
+		TenantID: "tenant", DeviceID: "device", BagName: "b.db3", IssuedAt: timeNow(),
+	}))
+	require.Nil(t, catalog.RecordCompleted(context.Background(), "tenant", "device", "c.db3", &uploadDigests{Size: 10}))
+
+	r := mux.NewRouter()
+	keys := newTestOperatorKeys(t)
+	r.Use(authorizeOperators(newTestOperatorAuth(t, keys)))
+	token := keys.token(t, "rsa", jwt.MapClaims{"groups": "tenant:viewer"})
+	r.Path("/tenants/{tenant}/devices/{device}/bags").Methods("GET").
+		Name("listBags").Handler(bagListHandler(backend, catalog))
+	list := func(t *testing.T, query string) (int, []*bagListing, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/tenants/tenant/devices/device/bags"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		var body struct {
+			Bags          []*bagListing `json:"bags"`
+			NextPageToken string        `json:"nextPageToken"`
+		}
+		if resp.Code == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+		return resp.Code, body.Bags, body.NextPageToken
+	}
+	names := func(bags []*bagListing) (names []string) {
+		for _, bag := range bags {
+			names = append(names, bag.Name)
+		}
+		return names
+	}
+
+	t.Run("all", func(t *testing.T) {
+		code, bags, next := list(t, "")
+		require.Equal(t, http.StatusOK, code)
+		require.Empty(t, next)
+		require.Equal(t, []*bagListing{
+			{Name: "a.db3", Size: 20, UploadedAt: base.Add(24 * time.Hour), Status: uploadStatusComplete},
+			{Name: "b.db3", Size: 30, UploadedAt: base.Add(48 * time.Hour), Status: uploadStatusPending},
+			{Name: "c.db3", Size: 10, UploadedAt: base, Status: uploadStatusUnexpected},
+		}, bags)
+	})
+	t.Run("sorting", func(t *testing.T) {
+		_, bags, _ := list(t, "?sort=-size")
+		require.Equal(t, []string{"b.db3", "a.db3", "c.db3"}, names(bags))
+		_, bags, _ = list(t, "?sort=uploadedAt")
+		require.Equal(t, []string{"c.db3", "a.db3", "b.db3"}, names(bags))
+		code, _, _ := list(t, "?sort=owner")
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+	t.Run("time range", func(t *testing.T) {
+		_, bags, _ := list(t, "?from=2021-03-21T00:00:00Z")
+		require.Equal(t, []string{"a.db3", "b.db3"}, names(bags))
+		_, bags, _ = list(t, "?from=2021-03-20T00:00:00Z&to=2021-03-22T00:00:00Z")
+		require.Equal(t, []string{"a.db3", "c.db3"}, names(bags))
+		code, _, _ := list(t, "?from=yesterday")
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+	t.Run("pagination", func(t *testing.T) {
+		_, bags, next := list(t, "?pageSize=2")
+		require.Equal(t, []string{"a.db3", "b.db3"}, names(bags))
+		require.NotEmpty(t, next)
+		_, bags, next = list(t, "?pageSize=2&pageToken="+next)
+		require.Equal(t, []string{"c.db3"}, names(bags))
+		require.Empty(t, next)
+		code, _, _ := list(t, "?pageSize=0")
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+	t.Run("unknown device", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/tenants/tenant/devices/other/bags", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.JSONEq(t, `{"bags": []}`, resp.Body.String())
+	})
+	t.Run("device token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/tenants/tenant/devices/device/bags", nil)
+		req.Header.Set("Authorization", "Bearer "+testGCP().newTestToken("device", "tenant", "", nil))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusForbidden, resp.Code)
+	})
+}
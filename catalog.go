@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+type catalogConfig struct {
+	// Driver is either "postgres" or "sqlite".
+	Driver string `config:"driver"`
+	// DSN is the data source name of the catalog database. Nothing is
+	// recorded if it is empty.
+	DSN string `config:"dsn"`
+}
+
+// Statuses of uploads recorded in the catalog.
+const (
+	// uploadStatusPending means that a URL has been issued but the upload has
+	// not been completed.
+	uploadStatusPending = "pending"
+	// uploadStatusComplete means that the bag has been uploaded.
+	uploadStatusComplete = "complete"
+	// uploadStatusUnexpected means that a bag was uploaded without a URL
+	// being issued for it. Objects under the data object prefix whose names
+	// are not of the form <tenant>/<device>/<bag> are recorded with this
+	// status, empty tenant and device IDs and the object name as the bag
+	// name.
+	uploadStatusUnexpected = "unexpected"
+)
+
+// bagUpload is an entry of the bag catalog. It is created when an upload URL
+// is issued and updated when the upload has been completed.
+type bagUpload struct {
+	ID          string    `json:"id"`
+	TenantID    string    `json:"tenantId"`
+	DeviceID    string    `json:"deviceId"`
+	BagName     string    `json:"bagName"`
+	Status      string    `json:"status"`
+	IssuedAt    time.Time `json:"issuedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	RequesterIP string    `json:"requesterIp"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`
+	MD5         string    `json:"md5,omitempty"`
+	CRC32C      string    `json:"crc32c,omitempty"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+var errUploadNotFound = errors.New("upload not found")
+
+// catalogSchema creates the catalog tables. Times are stored as Unix seconds
+// so that they can be compared the same way in every database.
+var catalogSchema = []string{
+	`CREATE TABLE IF NOT EXISTS bag_uploads (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	bag_name TEXT NOT NULL,
+	status TEXT NOT NULL,
+	issued_at BIGINT,
+	expires_at BIGINT,
+	requester_ip TEXT,
+	size BIGINT,
+	sha256 TEXT,
+	md5 TEXT,
+	crc32c TEXT,
+	completed_at BIGINT
+)`,
+	`CREATE INDEX IF NOT EXISTS bag_uploads_bag ON bag_uploads (tenant_id, device_id, bag_name)`,
+	`CREATE TABLE IF NOT EXISTS operator_roles (
+	subject TEXT NOT NULL,
+	tenant_id TEXT NOT NULL,
+	role TEXT NOT NULL,
+	PRIMARY KEY (subject, tenant_id, role)
+)`,
+}
+
+const selectBagUploads = `SELECT id, tenant_id, device_id, bag_name, status,
+	COALESCE(issued_at, 0), COALESCE(expires_at, 0), COALESCE(requester_ip, ''),
+	COALESCE(size, 0), COALESCE(sha256, ''), COALESCE(md5, ''), COALESCE(crc32c, ''),
+	COALESCE(completed_at, 0)
+FROM bag_uploads`
+
+// bagCatalog records every issued upload URL and every completed upload in a
+// SQL database. A nil catalog records nothing.
+type bagCatalog struct {
+	// ClientIP returns the address of the client which requested a URL. The
+	// address of the connection is used if it is nil.
+	ClientIP func(r *http.Request) string
+
+	db *sql.DB
+}
+
+// newBagCatalog returns the catalog configured in config or nil if the catalog
+// is disabled.
+func newBagCatalog(config *configuration) (*bagCatalog, error) {
+	c := config.Catalog
+	if c.DSN == "" {
+		return nil, nil
+	}
+	if c.Driver == "" {
+		return nil, errors.New("catalog.driver must be set when catalog.dsn is set")
+	}
+	catalog, err := openBagCatalog(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	// The requester is the client whose requests are rate limited.
+	catalog.ClientIP = config.RateLimits.clientIP
+	return catalog, nil
+}
+
+// openBagCatalog opens the catalog database and creates the tables if they do
+// not exist.
+func openBagCatalog(driver, dsn string) (*bagCatalog, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog database: %w", err)
+	}
+	for _, stmt := range catalogSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create catalog tables: %w", err)
+		}
+	}
+	return &bagCatalog{db: db}, nil
+}
+
+// unixTime converts a time stored in the catalog to time.Time. Zero is
+// converted to the zero time.
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+func scanBagUpload(row interface{ Scan(...interface{}) error }) (*bagUpload, error) {
+	var (
+		u                               bagUpload
+		issuedAt, expiresAt, completeAt int64
+	)
+	err := row.Scan(
+		&u.ID, &u.TenantID, &u.DeviceID, &u.BagName, &u.Status,
+		&issuedAt, &expiresAt, &u.RequesterIP,
+		&u.Size, &u.SHA256, &u.MD5, &u.CRC32C,
+		&completeAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	u.IssuedAt = unixTime(issuedAt)
+	u.ExpiresAt = unixTime(expiresAt)
+	u.CompletedAt = unixTime(completeAt)
+	return &u, nil
+}
+
+// Get returns the upload with the given ID. errUploadNotFound is returned if
+// it does not exist.
+func (c *bagCatalog) Get(ctx context.Context, id string) (*bagUpload, error) {
+	u, err := scanBagUpload(c.db.QueryRowContext(ctx, selectBagUploads+` WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUploadNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read upload from catalog: %w", err)
+	}
+	return u, nil
+}
+
+// RecordIssued adds a pending upload to the catalog. The ID of the upload is
+// generated if it is empty.
+func (c *bagCatalog) RecordIssued(ctx context.Context, u *bagUpload) error {
+	if c == nil {
+		return nil
+	}
+	if u.ID == "" {
+		id, err := newRandomID()
+		if err != nil {
+			return err
+		}
+		u.ID = id
+	}
+	u.Status = uploadStatusPending
+	_, err := c.db.ExecContext(ctx, `INSERT INTO bag_uploads
+	(id, tenant_id, device_id, bag_name, status, issued_at, expires_at, requester_ip)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		u.ID, u.TenantID, u.DeviceID, u.BagName, u.Status,
+		u.IssuedAt.Unix(), u.ExpiresAt.Unix(), u.RequesterIP,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record issued upload: %w", err)
+	}
+	return nil
+}
+
+// completeUpload is the statement which marks an upload complete. The
+// parameters following the completion time select the upload.
+const completeUpload = `UPDATE bag_uploads
+SET status = $1, size = $2, sha256 = $3, md5 = $4, crc32c = $5, completed_at = $6
+WHERE `
+
+// complete marks the uploads selected by where complete and reports whether
+// any upload was updated.
+func (c *bagCatalog) complete(ctx context.Context, d *uploadDigests, where string, args ...interface{}) (bool, error) {
+	args = append([]interface{}{
+		uploadStatusComplete, d.Size, d.SHA256, d.MD5, d.CRC32C, timeNow().Unix(),
+	}, args...)
+	res, err := c.db.ExecContext(ctx, completeUpload+where, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to record completed upload: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to record completed upload: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Complete marks the upload with the given ID complete. errUploadNotFound is
+// returned if it does not exist.
+func (c *bagCatalog) Complete(ctx context.Context, id string, d *uploadDigests) error {
+	found, err := c.complete(ctx, d, `id = $7`, id)
+	if err != nil {
+		return err
+	} else if !found {
+		return errUploadNotFound
+	}
+	return nil
+}
+
+// RecordCompleted marks the latest pending upload of the bag complete. If no
+// upload is pending and the bag has not already been recorded with the same
+// digests, it is recorded as an unexpected upload. Completions can therefore be
+// reported more than once, e.g. by both the device and a notification.
+func (c *bagCatalog) RecordCompleted(
+	ctx context.Context,
+	tenantID, deviceID, bagName string,
+	d *uploadDigests,
+) error {
+	if c == nil {
+		return nil
+	}
+	found, err := c.complete(ctx, d, `id = (
+	SELECT id FROM bag_uploads
+	WHERE tenant_id = $7 AND device_id = $8 AND bag_name = $9 AND status = $10
+	ORDER BY issued_at DESC
+	LIMIT 1
+)`, tenantID, deviceID, bagName, uploadStatusPending)
+	if err != nil || found {
+		return err
+	}
+	var recorded int
+	err = c.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM bag_uploads
+WHERE tenant_id = $1 AND device_id = $2 AND bag_name = $3 AND status <> $4
+	AND size = $5 AND md5 = $6 AND crc32c = $7`,
+		tenantID, deviceID, bagName, uploadStatusPending, d.Size, d.MD5, d.CRC32C,
+	).Scan(&recorded)
+	if err != nil {
+		return fmt.Errorf("failed to read uploads from catalog: %w", err)
+	} else if recorded > 0 {
+		return nil
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return err
+	}
+	_, err = c.db.ExecContext(ctx, `INSERT INTO bag_uploads
+	(id, tenant_id, device_id, bag_name, status, size, sha256, md5, crc32c, completed_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		id, tenantID, deviceID, bagName, uploadStatusUnexpected,
+		d.Size, d.SHA256, d.MD5, d.CRC32C, timeNow().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record unexpected upload: %w", err)
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client which made the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requesterIP returns the address of the client which made the request.
+func (c *bagCatalog) requesterIP(r *http.Request) string {
+	if c.ClientIP == nil {
+		return clientIP(r)
+	}
+	return c.ClientIP(r)
+}
+
+// recordIssuedURL adds the URL issued to the device to the catalog and sets
+// the ID of the upload in u.
+func recordIssuedURL(r *http.Request, catalog *bagCatalog, claims *jwtClaims, name string, u *signedURL) error {
+	if catalog == nil {
+		return nil
+	}
+	upload := &bagUpload{
+		TenantID:    claims.TenantID,
+		DeviceID:    claims.DeviceID,
+		BagName:     name,
+		IssuedAt:    timeNow(),
+		ExpiresAt:   u.Expires,
+		RequesterIP: catalog.requesterIP(r),
+	}
+	if err := catalog.RecordIssued(r.Context(), upload); err != nil {
+		return err
+	}
+	u.UploadID = upload.ID
+	return nil
+}
+
+// Statuses returns the status of the latest upload of every bag of the device
+// which has been recorded in the catalog. A nil catalog returns no statuses.
+func (c *bagCatalog) Statuses(ctx context.Context, tenantID, deviceID string) (map[string]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rows, err := c.db.QueryContext(ctx, `SELECT bag_name, status FROM bag_uploads
+WHERE tenant_id = $1 AND device_id = $2
+ORDER BY COALESCE(completed_at, issued_at, 0), id`, tenantID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploads from catalog: %w", err)
+	}
+	defer rows.Close()
+	statuses := map[string]string{}
+	for rows.Next() {
+		var name, status string
+		if err := rows.Scan(&name, &status); err != nil {
+			return nil, fmt.Errorf("failed to read uploads from catalog: %w", err)
+		}
+		statuses[name] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read uploads from catalog: %w", err)
+	}
+	return statuses, nil
+}
+
+// OperatorRoles returns the roles granted to the operator in the catalog by
+// tenant. A nil catalog returns no roles.
+func (c *bagCatalog) OperatorRoles(ctx context.Context, subject string) (map[string][]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rows, err := c.db.QueryContext(ctx, `SELECT tenant_id, role FROM operator_roles WHERE subject = $1`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operator roles from catalog: %w", err)
+	}
+	defer rows.Close()
+	roles := map[string][]string{}
+	for rows.Next() {
+		var tenantID, role string
+		if err := rows.Scan(&tenantID, &role); err != nil {
+			return nil, fmt.Errorf("failed to read operator roles from catalog: %w", err)
+		}
+		roles[tenantID] = append(roles[tenantID], role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read operator roles from catalog: %w", err)
+	}
+	return roles, nil
+}
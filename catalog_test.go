@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testCatalog(t *testing.T) *bagCatalog {
+	t.Helper()
+	catalog, err := openBagCatalog("sqlite", filepath.Join(t.TempDir(), "catalog.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { catalog.db.Close() })
+	return catalog
+}
+
+// catalogUploads returns the uploads of the bag in the order they were issued.
+func catalogUploads(t *testing.T, catalog *bagCatalog, bagName string) []*bagUpload {
+	t.Helper()
+	rows, err := catalog.db.Query(selectBagUploads+` WHERE bag_name = $1 ORDER BY issued_at, id`, bagName)
+	require.Nil(t, err)
+	defer rows.Close()
+	var uploads []*bagUpload
+	for rows.Next() {
+		u, err := scanBagUpload(rows)
+		require.Nil(t, err)
+		uploads = append(uploads, u)
+	}
+	require.Nil(t, rows.Err())
+	return uploads
+}
+
+func TestBagCatalog(t *testing.T) {
+	gcp := testGCP()
+	catalog := testCatalog(t)
+	backend := &localBackend{
+		Dir:             t.TempDir(),
+		Host:            "http://localhost:9000",
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	issueURL := authenticateDevice(readTokenWithoutValidation, uploadURLHandler(backend, &uploadPolicy{}, catalog))
+	receiveUpload := receiveUploadHandler(backend, catalog)
+
+	t.Run("issued and completed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/generate-url", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Add("Authorization", "Bearer "+gcp.newTestToken("existing", "", "a.db3", nil))
+		resp := httptest.NewRecorder()
+		issueURL.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var u signedURL
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&u))
+
+		uploads := catalogUploads(t, catalog, "a.db3")
+		require.Len(t, uploads, 1)
+		issued := uploads[0]
+		require.Equal(t, uploadStatusPending, issued.Status)
+		require.Equal(t, "test-tenant", issued.TenantID)
+		require.Equal(t, "existing", issued.DeviceID)
+		require.Equal(t, "192.0.2.1", issued.RequesterIP)
+		require.Equal(t, timeNow().UTC(), issued.IssuedAt)
+		require.Equal(t, timeNow().Add(5*time.Minute).UTC(), issued.ExpiresAt)
+
+		req = httptest.NewRequest("PUT", u.URL, strings.NewReader("hello world"))
+		resp = httptest.NewRecorder()
+		receiveUpload.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		completed, err := catalog.Get(context.Background(), issued.ID)
+		require.Nil(t, err)
+		require.Equal(t, uploadStatusComplete, completed.Status)
+		require.Equal(t, int64(11), completed.Size)
+		require.Equal(t, helloWorldSHA256, completed.SHA256)
+		require.Equal(t, helloWorldMD5, completed.MD5)
+		require.Equal(t, helloWorldCRC32C, completed.CRC32C)
+		require.Equal(t, timeNow().UTC(), completed.CompletedAt)
+	})
+	t.Run("unexpected upload", func(t *testing.T) {
+		require.Nil(t, catalog.RecordCompleted(
+			context.Background(), "test-tenant", "existing", "b.db3", &uploadDigests{Size: 3},
+		))
+		uploads := catalogUploads(t, catalog, "b.db3")
+		require.Len(t, uploads, 1)
+		require.Equal(t, uploadStatusUnexpected, uploads[0].Status)
+		require.Equal(t, int64(3), uploads[0].Size)
+		require.True(t, uploads[0].IssuedAt.IsZero())
+	})
+	t.Run("forwarded requester", func(t *testing.T) {
+		// The requester is resolved like the client of the rate limiter.
+		ipConfig := &rateConfig{ClientIPHeader: "X-Forwarded-For"}
+		catalog.ClientIP = ipConfig.clientIP
+		defer func() { catalog.ClientIP = nil }()
+		req := httptest.NewRequest("POST", "/generate-url", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1, 192.0.2.2")
+		req.Header.Add("Authorization", "Bearer "+gcp.newTestToken("existing", "", "c.db3", nil))
+		resp := httptest.NewRecorder()
+		issueURL.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		uploads := catalogUploads(t, catalog, "c.db3")
+		require.Len(t, uploads, 1)
+		require.Equal(t, "192.0.2.2", uploads[0].RequesterIP)
+	})
+	t.Run("missing upload", func(t *testing.T) {
+		_, err := catalog.Get(context.Background(), "missing")
+		require.ErrorIs(t, err, errUploadNotFound)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadCompletion is sent by the device after it has uploaded a bag. The
+// fields are optional and the stored bag is checked against the ones which
+// are set.
+type uploadCompletion struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+	CRC32C string `json:"crc32c"`
+}
+
+// errObjectMismatch is returned when the stored bag does not match what the
+// device reported.
+var errObjectMismatch = errors.New("uploaded bag does not match")
+
+// verify checks that the object matches the completion. Checksums which the
+// storage does not report cannot be checked.
+func (c *uploadCompletion) verify(info *objectInfo) error {
+	if c.Size > 0 && c.Size != info.Size {
+		return fmt.Errorf("%w: size is %d", errObjectMismatch, info.Size)
+	}
+	for _, sum := range []struct{ name, declared, stored string }{
+		{"SHA-256", c.SHA256, info.SHA256},
+		{"MD5", c.MD5, info.MD5},
+		{"CRC32C", c.CRC32C, info.CRC32C},
+	} {
+		if sum.declared != "" && sum.stored != "" && sum.declared != sum.stored {
+			return fmt.Errorf("%w: %s is %s", errObjectMismatch, sum.name, sum.stored)
+		}
+	}
+	return nil
+}
+
+// uploadCompletionHandler marks an upload complete after checking that the
+// bag exists in the storage and matches the completion sent by the device.
+// Devices can only complete their own uploads.
+func uploadCompletionHandler(backend StorageBackend, catalog *bagCatalog) deviceHandler {
+	return func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+		var completion uploadCompletion
+		err := json.NewDecoder(r.Body).Decode(&completion)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeErrMsg(rw, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		upload, err := catalog.Get(r.Context(), mux.Vars(r)["id"])
+		if errors.Is(err, errUploadNotFound) ||
+			(err == nil && (upload.TenantID != claims.TenantID || upload.DeviceID != claims.DeviceID)) {
+			writeErrMsg(rw, http.StatusNotFound, errUploadNotFound.Error())
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		info, err := backend.Stat(r.Context(), upload.TenantID, upload.DeviceID, upload.BagName)
+		if errors.Is(err, errObjectNotFound) {
+			writeErrMsg(rw, http.StatusConflict, "bag has not been uploaded")
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		if err := completion.verify(info); err != nil {
+			logErrorf("upload %s of device '%s/%s': %v", upload.ID, upload.TenantID, upload.DeviceID, err)
+			writeErrMsg(rw, http.StatusConflict, err.Error())
+			return
+		}
+		if err := catalog.Complete(r.Context(), upload.ID, info.digests()); err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		if upload, err = catalog.Get(r.Context(), upload.ID); err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		writeJSON(rw, upload)
+	}
+}
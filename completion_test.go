@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadCompletion(t *testing.T) {
+	gcp := testGCP()
+	catalog := testCatalog(t)
+	backend := &localBackend{
+		Dir:             t.TempDir(),
+		Host:            "http://localhost:9000",
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	r := mux.NewRouter()
+	r.Path("/generate-url").Methods("POST").Handler(
+		authenticateDevice(readTokenWithoutValidation, uploadURLHandler(backend, &uploadPolicy{}, catalog)),
+	)
+	r.Path("/uploads/{id}/complete").Methods("POST").Handler(
+		authenticateDevice(readTokenWithoutValidation, uploadCompletionHandler(backend, catalog)),
+	)
+	do := func(t *testing.T, device, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+gcp.newTestToken(device, "", "a.db3", nil))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do(t, "existing", "/generate-url", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var u signedURL
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&u))
+	require.NotEmpty(t, u.UploadID)
+	completePath := "/uploads/" + u.UploadID + "/complete"
+
+	t.Run("not uploaded", func(t *testing.T) {
+		resp := do(t, "existing", completePath, "")
+		require.Equal(t, http.StatusConflict, resp.Code)
+		upload, err := catalog.Get(context.Background(), u.UploadID)
+		require.Nil(t, err)
+		require.Equal(t, uploadStatusPending, upload.Status)
+	})
+
+	deviceDir := filepath.Join(backend.Dir, "test-tenant", "existing")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "a.db3"), []byte("hello world"), 0o600))
+	require.Nil(t, writeDigests(filepath.Join(deviceDir, "a.db3"), &uploadDigests{
+		Size:   11,
+		SHA256: helloWorldSHA256,
+		MD5:    helloWorldMD5,
+		CRC32C: helloWorldCRC32C,
+	}))
+
+	t.Run("other device", func(t *testing.T) {
+		resp := do(t, "another", completePath, "")
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+	t.Run("unknown upload", func(t *testing.T) {
+		resp := do(t, "existing", "/uploads/unknown/complete", "")
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		resp := do(t, "existing", completePath, `{"size": 12}`)
+		require.Equal(t, http.StatusConflict, resp.Code)
+		resp = do(t, "existing", completePath, `{"md5": "AAAAAAAAAAAAAAAAAAAAAA=="}`)
+		require.Equal(t, http.StatusConflict, resp.Code)
+		resp = do(t, "existing", completePath, `{"size": `)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+	t.Run("complete", func(t *testing.T) {
+		resp := do(t, "existing", completePath, `{"size": 11, "sha256": "`+helloWorldSHA256+`"}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var upload bagUpload
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&upload))
+		require.Equal(t, uploadStatusComplete, upload.Status)
+		require.Equal(t, int64(11), upload.Size)
+		require.Equal(t, helloWorldMD5, upload.MD5)
+		require.Equal(t, timeNow().UTC(), upload.CompletedAt)
+	})
+}
+
+func TestUploadCompletionVerify(t *testing.T) {
+	info := &objectInfo{Size: 11, MD5: helloWorldMD5}
+	require.Nil(t, (&uploadCompletion{}).verify(info))
+	require.Nil(t, (&uploadCompletion{Size: 11, MD5: helloWorldMD5}).verify(info))
+	// The storage does not report SHA-256 hashes.
+	require.Nil(t, (&uploadCompletion{SHA256: "AAAA"}).verify(info))
+	require.ErrorIs(t, (&uploadCompletion{Size: 10}).verify(info), errObjectMismatch)
+	require.ErrorIs(t, (&uploadCompletion{CRC32C: "AAAAAA=="}).verify(&objectInfo{CRC32C: "yZRlqg=="}), errObjectMismatch)
+}
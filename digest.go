@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5" //#nosec G501
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digestFileSuffix is appended to the hidden file next to a bag in local mode
+// which contains the verified digests of the bag.
+const digestFileSuffix = ".digests.json"
+
+// errDigestMismatch is returned when the content does not match a checksum
+// declared by the device.
+var errDigestMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// uploadDigests contains the digests of uploaded content. The digests are base64
+// encoded.
+type uploadDigests struct {
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	MD5        string    `json:"md5"`
+	CRC32C     string    `json:"crc32c"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// digester computes the digests of everything written to it.
+type digester struct {
+	sha256, md5, crc32c hash.Hash
+	size                int64
+}
+
+func newDigester() *digester {
+	return &digester{
+		sha256: sha256.New(),
+		md5:    md5.New(), //#nosec G401
+		crc32c: crc32.New(crc32cTable),
+	}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.md5.Write(p)
+	d.crc32c.Write(p)
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+func (d *digester) Digests() *uploadDigests {
+	return &uploadDigests{
+		Size:       d.size,
+		SHA256:     base64.StdEncoding.EncodeToString(d.sha256.Sum(nil)),
+		MD5:        base64.StdEncoding.EncodeToString(d.md5.Sum(nil)),
+		CRC32C:     base64.StdEncoding.EncodeToString(d.crc32c.Sum(nil)),
+		VerifiedAt: timeNow().UTC(),
+	}
+}
+
+// verify checks that the digests match the checksums in every one of
+// constraints.
+func (d *uploadDigests) verify(constraints ...uploadConstraints) error {
+	for _, c := range constraints {
+		if c.ContentSHA256 != "" && c.ContentSHA256 != d.SHA256 {
+			return fmt.Errorf("%w: SHA-256 is %s", errDigestMismatch, d.SHA256)
+		}
+		if c.ContentMD5 != "" && c.ContentMD5 != d.MD5 {
+			return fmt.Errorf("%w: MD5 is %s", errDigestMismatch, d.MD5)
+		}
+		if c.ContentCRC32C != "" && c.ContentCRC32C != d.CRC32C {
+			return fmt.Errorf("%w: CRC32C is %s", errDigestMismatch, d.CRC32C)
+		}
+	}
+	return nil
+}
+
+// checksumHeaders returns the checksums the client has declared in the
+// headers of an upload request. The headers used by GCS are supported
+// together with X-Checksum-Sha256.
+func checksumHeaders(h http.Header) (uploadConstraints, error) {
+	c := uploadConstraints{
+		ContentMD5:    h.Get("Content-MD5"),
+		ContentSHA256: h.Get("X-Checksum-Sha256"),
+	}
+	for _, value := range h.Values("X-Goog-Hash") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if sum := strings.TrimPrefix(part, "crc32c="); sum != part {
+				c.ContentCRC32C = sum
+			} else if sum := strings.TrimPrefix(part, "md5="); sum != part {
+				if c.ContentMD5 != "" && c.ContentMD5 != sum {
+					return c, errors.New("conflicting MD5 hashes")
+				}
+				c.ContentMD5 = sum
+			}
+		}
+	}
+	return c, c.validate()
+}
+
+// constraintsFromQuery returns the checksums and the maximum size bound into a
+// signed local URL.
+func constraintsFromQuery(r *http.Request) uploadConstraints {
+	q := r.URL.Query()
+	// The parameter is covered by the signature so it is always valid.
+	maxSize, _ := strconv.ParseInt(q.Get("maxSize"), 10, 64)
+	return uploadConstraints{
+		ContentMD5:    q.Get("contentMD5"),
+		ContentCRC32C: q.Get("contentCRC32C"),
+		ContentSHA256: q.Get("contentSHA256"),
+		MaxSize:       maxSize,
+	}
+}
+
+func digestFilePath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+digestFileSuffix)
+}
+
+// writeDigests stores the digests of the file at filePath next to it.
+func writeDigests(filePath string, d *uploadDigests) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(digestFilePath(filePath), bytes.NewReader(data), int64(len(data)), nil, false)
+}
+
+// readDigests returns the digests stored next to the file at filePath.
+func readDigests(filePath string) (*uploadDigests, error) {
+	data, err := os.ReadFile(digestFilePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	var d uploadDigests
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// digestFile computes the digests of an existing file.
+func digestFile(filePath string) (*uploadDigests, error) {
+	f, err := os.Open(filePath) //#nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := newDigester()
+	if _, err := io.Copy(d, f); err != nil {
+		return nil, err
+	}
+	return d.Digests(), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	helloWorldSHA256 = "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="
+	helloWorldMD5    = "XrY7u+Ae7tCTyyK7j1rNww=="
+	helloWorldCRC32C = "yZRlqg=="
+)
+
+func TestDigests(t *testing.T) {
+	d := newDigester()
+	_, err := strings.NewReader("hello world").WriteTo(d)
+	require.Nil(t, err)
+	digests := d.Digests()
+	require.Equal(t, int64(11), digests.Size)
+	require.Equal(t, helloWorldSHA256, digests.SHA256)
+	require.Equal(t, helloWorldMD5, digests.MD5)
+	require.Equal(t, helloWorldCRC32C, digests.CRC32C)
+
+	require.Nil(t, digests.verify())
+	require.Nil(t, digests.verify(
+		uploadConstraints{ContentSHA256: helloWorldSHA256},
+		uploadConstraints{ContentMD5: helloWorldMD5, ContentCRC32C: helloWorldCRC32C},
+	))
+	require.ErrorIs(t, digests.verify(
+		uploadConstraints{ContentSHA256: helloWorldSHA256},
+		uploadConstraints{ContentCRC32C: "AAAAAA=="},
+	), errDigestMismatch)
+}
+
+func TestChecksumHeaders(t *testing.T) {
+	c, err := checksumHeaders(http.Header{
+		"X-Goog-Hash":       {"crc32c=" + helloWorldCRC32C + ", md5=" + helloWorldMD5},
+		"X-Checksum-Sha256": {helloWorldSHA256},
+	})
+	require.Nil(t, err)
+	require.Equal(t, uploadConstraints{
+		ContentMD5:    helloWorldMD5,
+		ContentCRC32C: helloWorldCRC32C,
+		ContentSHA256: helloWorldSHA256,
+	}, c)
+
+	_, err = checksumHeaders(http.Header{
+		"Content-Md5": {helloWorldMD5},
+		"X-Goog-Hash": {"md5=AAAAAAAAAAAAAAAAAAAAAA=="},
+	})
+	require.Error(t, err)
+	_, err = checksumHeaders(http.Header{"X-Checksum-Sha256": {"invalid"}})
+	require.Error(t, err)
+}
+
+func TestGCSChecksumHeaders(t *testing.T) {
+	gen := &urlGenerator{
+		Bucket:        "testbucket",
+		Account:       "testaccount",
+		SigningKey:    testGCP().rawPrivateKey,
+		ValidDuration: 5 * time.Minute,
+		Scheme:        "v4",
+	}
+	url, err := gen.GenerateUpload("test-tenant", "existing", "a.db3", uploadConstraints{
+		ContentMD5:    helloWorldMD5,
+		ContentCRC32C: helloWorldCRC32C,
+		ContentSHA256: helloWorldSHA256,
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"Content-MD5":        helloWorldMD5,
+		"x-goog-hash":        "crc32c=" + helloWorldCRC32C,
+		"x-goog-meta-sha256": helloWorldSHA256,
+	}, url.Headers)
+	require.Contains(t, url.URL, "X-Goog-SignedHeaders=content-md5%3Bhost%3Bx-goog-hash%3Bx-goog-meta-sha256&")
+}
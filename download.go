@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// bagRequest is the body of operator requests concerning a single bag.
+type bagRequest struct {
+	TenantID string `json:"tenantId"`
+	DeviceID string `json:"deviceId"`
+	BagName  string `json:"bagName"`
+}
+
+// readBagRequest reads the body of an operator request. If the body is
+// invalid, an error is written and false is returned.
+func readBagRequest(rw http.ResponseWriter, r *http.Request) (*bagRequest, bool) {
+	var req bagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrMsg(rw, http.StatusBadRequest, "invalid request body")
+		return nil, false
+	}
+	if req.TenantID == "" || req.DeviceID == "" {
+		writeErrMsg(rw, http.StatusBadRequest, "tenantId and deviceId are required")
+		return nil, false
+	} else if req.BagName == "" {
+		writeErrMsg(rw, http.StatusBadRequest, "bagName is required")
+		return nil, false
+	}
+	// The IDs are used as path segments of the object name.
+	for _, segment := range []string{req.TenantID, req.DeviceID, req.BagName} {
+		if pathSegmentSanitizer.Replace(segment) != segment {
+			writeErrMsg(rw, http.StatusBadRequest, "invalid path segment: "+segment)
+			return nil, false
+		}
+	}
+	if err := checkBagName(req.BagName); err != nil {
+		writeErrMsg(rw, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return &req, true
+}
+
+// downloadURLHandler returns a signed URL which can be used to download a
+// bag. The URL expires after urlValidDuration.
+func downloadURLHandler(backend StorageBackend) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		req, ok := readBagRequest(rw, r)
+		if !ok {
+			return
+		}
+		op := operatorFromContext(r.Context())
+		if !op.can(req.TenantID, permDownloadBags) {
+			writePermissionDenied(rw, req.TenantID, permDownloadBags)
+			return
+		}
+		_, err := backend.Stat(r.Context(), req.TenantID, req.DeviceID, req.BagName)
+		if errors.Is(err, errObjectNotFound) {
+			writeErrMsg(rw, http.StatusNotFound, "bag not found")
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		u, err := backend.DownloadURL(r.Context(), req.TenantID, req.DeviceID, req.BagName)
+		if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		logInfof("issued download URL of bag '%s/%s/%s' to operator '%s'", req.TenantID, req.DeviceID, req.BagName, op.Subject)
+		writeJSON(rw, jsonObj{"url": u})
+	}
+}
+
+// sendDownloadHandler serves bags in local mode using URLs returned by
+// localBackend.DownloadURL. Range requests are supported.
+func sendDownloadHandler(backend *localBackend) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := backend.verifyURL(r, "/download"); err != nil {
+			writeErrMsg(rw, http.StatusForbidden, err.Error())
+			return
+		}
+		query := r.URL.Query()
+		bagName := query.Get("bagName")
+		f, err := os.Open(backend.filePath(query.Get("tenant"), query.Get("device"), bagName))
+		if errors.Is(err, os.ErrNotExist) {
+			writeErrMsg(rw, http.StatusNotFound, "bag not found")
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(rw, r, bagName, fi.ModTime(), f)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadURL(t *testing.T) {
+	backend := &localBackend{
+		Dir:           t.TempDir(),
+		Host:          "http://localhost:9000",
+		SigningKey:    []byte("secret"),
+		ValidDuration: 5 * time.Minute,
+	}
+	deviceDir := filepath.Join(backend.Dir, "tenant", "device")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "a.db3"), []byte("hello world"), 0o600))
+	generate := mux.NewRouter()
+	keys := newTestOperatorKeys(t)
+	generate.Use(authorizeOperators(newTestOperatorAuth(t, keys)))
+	token := keys.token(t, "rsa", jwt.MapClaims{"groups": "tenant:viewer"})
+	generate.Path("/download-url").Methods("POST").Name("downloadURL").Handler(downloadURLHandler(backend))
+	download := sendDownloadHandler(backend)
+
+	requestURL := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/download-url", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		generate.ServeHTTP(resp, req)
+		return resp
+	}
+	downloadURL := func(t *testing.T) string {
+		t.Helper()
+		resp := requestURL(t, `{"tenantId": "tenant", "deviceId": "device", "bagName": "a.db3"}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var body struct{ URL string }
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.True(t, strings.HasPrefix(body.URL, "http://localhost:9000/download?"))
+		return body.URL
+	}
+
+	t.Run("full", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		download.ServeHTTP(resp, httptest.NewRequest("GET", downloadURL(t), nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Equal(t, "hello world", resp.Body.String())
+		require.Equal(t, "bytes", resp.Header().Get("Accept-Ranges"))
+	})
+	t.Run("range", func(t *testing.T) {
+		req := httptest.NewRequest("GET", downloadURL(t), nil)
+		req.Header.Set("Range", "bytes=6-")
+		resp := httptest.NewRecorder()
+		download.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusPartialContent, resp.Code)
+		require.Equal(t, "world", resp.Body.String())
+		require.Equal(t, "bytes 6-10/11", resp.Header().Get("Content-Range"))
+	})
+	t.Run("tampered", func(t *testing.T) {
+		u, err := url.Parse(downloadURL(t))
+		require.Nil(t, err)
+		q := u.Query()
+		q.Set("device", "other")
+		u.RawQuery = q.Encode()
+		resp := httptest.NewRecorder()
+		download.ServeHTTP(resp, httptest.NewRequest("GET", u.String(), nil))
+		require.Equal(t, http.StatusForbidden, resp.Code)
+	})
+	t.Run("expired", func(t *testing.T) {
+		u := downloadURL(t)
+		expired := timeNow().Add(backend.ValidDuration)
+		defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+		timeNow = func() time.Time { return expired }
+		resp := httptest.NewRecorder()
+		download.ServeHTTP(resp, httptest.NewRequest("GET", u, nil))
+		require.Equal(t, http.StatusForbidden, resp.Code)
+	})
+	t.Run("invalid requests", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound,
+			requestURL(t, `{"tenantId": "tenant", "deviceId": "device", "bagName": "b.db3"}`).Code)
+		require.Equal(t, http.StatusBadRequest,
+			requestURL(t, `{"tenantId": "tenant", "deviceId": "device"}`).Code)
+		require.Equal(t, http.StatusBadRequest,
+			requestURL(t, `{"tenantId": "tenant", "deviceId": "..", "bagName": "a.db3"}`).Code)
+	})
+	t.Run("device token", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/download-url", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+testGCP().newTestToken("device", "tenant", "", nil))
+		resp := httptest.NewRecorder()
+		generate.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusForbidden, resp.Code)
+	})
+}
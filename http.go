@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 )
 
@@ -43,11 +44,33 @@ func (rw *loggerResponseWriter) Write(data []byte) (int, error) {
 	return rw.ResponseWriter.Write(data)
 }
 
+// redactedQueryParams contains the query parameters whose values are secrets
+// and are not logged.
+var redactedQueryParams = []string{"token"}
+
+// redactURL returns the URL with the values of redactedQueryParams replaced.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, param := range redactedQueryParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	copied := *u
+	copied.RawQuery = query.Encode()
+	return copied.String()
+}
+
 func requestLoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		logrw := newLoggerResponseWriter(rw)
 		next.ServeHTTP(logrw, r)
-		logInfof("%s %s %d %s", r.Proto, r.Method, logrw.code, r.URL.String())
+		logInfof("%s %s %d %s", r.Proto, r.Method, logrw.code, redactURL(r.URL))
 	})
 }
 
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksRefreshInterval is how long a loaded key set is used before it is
+	// loaded again.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often the key set is reloaded because
+	// a token was signed with an unknown key, and how often failed loads are
+	// retried.
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jsonWebKey is a public key in the JWK format of RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// publicKey returns the key as a type accepted by the jwt package.
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve: " + k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve: " + k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.New("unsupported key type: " + k.Kty)
+	}
+}
+
+// parseJWKS parses a JWK set and returns its signing keys by key ID. Keys
+// which cannot be used are skipped and logged.
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logWarnf("skipping JWKS key number %d (kid '%s'): %v", i, jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// jwksKeySet caches the keys of a JWK set. The set is loaded when it is first
+// used, periodically after that, and when a token is signed with an unknown
+// key.
+type jwksKeySet struct {
+	// Load returns the JWK set.
+	Load func(ctx context.Context) ([]byte, error)
+
+	// group combines concurrent reloads into one.
+	group    singleflight.Group
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	loadedAt time.Time
+	// attemptedAt is the time of the last load, successful or not, and
+	// loadErr is the error of the last failed load.
+	attemptedAt time.Time
+	loadErr     error
+}
+
+// reload loads the set and returns its keys. The set is loaded without
+// holding the mutex so that tokens can be verified with the previously loaded
+// keys in the meantime.
+func (s *jwksKeySet) reload(ctx context.Context) (map[string]interface{}, error) {
+	keys, err, _ := s.group.Do("", func() (interface{}, error) {
+		data, err := s.Load(ctx)
+		var keys map[string]interface{}
+		if err == nil {
+			keys, err = parseJWKS(data)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attemptedAt = timeNow()
+		s.loadErr = err
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+		s.loadedAt = s.attemptedAt
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys.(map[string]interface{}), nil
+}
+
+// Key returns the key with the given ID. If the set contains only one key, it
+// is also used for tokens without a key ID.
+func (s *jwksKeySet) Key(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.Lock()
+	keys, loadedAt, attemptedAt, loadErr := s.keys, s.loadedAt, s.attemptedAt, s.loadErr
+	s.mu.Unlock()
+	now := timeNow()
+	_, known := keys[kid]
+	stale := keys == nil || now.Sub(loadedAt) > jwksRefreshInterval || !known
+	// Failed loads are not retried immediately either so that tokens with
+	// unknown key IDs cannot cause a request to the IdP each.
+	if stale && (attemptedAt.IsZero() || now.Sub(attemptedAt) > jwksMinRefreshInterval) {
+		reloaded, err := s.reload(ctx)
+		if err != nil {
+			if keys == nil {
+				return nil, err
+			}
+			// Previously loaded keys are used while the set is unavailable.
+			logWarnf("failed to reload JWKS: %v", err)
+		} else {
+			keys = reloaded
+		}
+	} else if keys == nil {
+		return nil, loadErr
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID: '%s'", kid)
+}
+
+// jwksFileLoader reads a JWK set from a local file.
+func jwksFileLoader(file string) func(context.Context) ([]byte, error) {
+	return func(context.Context) ([]byte, error) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS: %w", err)
+		}
+		return data, nil
+	}
+}
+
+func httpGet(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jwksURLLoader fetches a JWK set from url. If url is empty, the URL is read
+// from the OpenID Connect discovery document of the issuer.
+func jwksURLLoader(client *http.Client, issuer, url string) func(context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		jwksURL := url
+		if jwksURL == "" {
+			data, err := httpGet(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch OpenID configuration: %w", err)
+			}
+			var discovery struct {
+				JWKSURI string `json:"jwks_uri"`
+			}
+			if err := json.Unmarshal(data, &discovery); err != nil {
+				return nil, fmt.Errorf("failed to parse OpenID configuration: %w", err)
+			} else if discovery.JWKSURI == "" {
+				return nil, errors.New("OpenID configuration does not contain jwks_uri")
+			}
+			jwksURL = discovery.JWKSURI
+		}
+		data, err := httpGet(ctx, client, jwksURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		return data, nil
+	}
+}
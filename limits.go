@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	errUploadTooLarge       = errors.New("upload exceeds the maximum size")
+	errInsufficientStorage  = errors.New("not enough free disk space")
+	errInvalidTenantSizeArg = errors.New("tenant sizes must be given as <tenant>=<bytes>")
+)
+
+// tenantSizes maps tenant keys to sizes in bytes. It can be given as a map in
+// the configuration file or as a comma-separated list of <tenant>=<bytes>
+// pairs in flags and environment variables.
+type tenantSizes map[string]int64
+
+func (s *tenantSizes) String() string {
+	pairs := make([]string, 0, len(*s))
+	for tenant, size := range *s {
+		pairs = append(pairs, tenant+"="+strconv.FormatInt(size, 10))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s *tenantSizes) Set(value string) error {
+	parsed, err := s.Parse(value)
+	if err != nil {
+		return err
+	}
+	*s = parsed.(tenantSizes)
+	return nil
+}
+
+func (s *tenantSizes) Type() string {
+	return "tenantSizes"
+}
+
+// Parse implements configloader.Option.
+func (s *tenantSizes) Parse(value interface{}) (interface{}, error) {
+	sizes := tenantSizes{}
+	switch value := value.(type) {
+	case string:
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			i := strings.IndexByte(pair, '=')
+			if i < 0 {
+				return nil, errInvalidTenantSizeArg
+			}
+			size, err := strconv.ParseInt(pair[i+1:], 10, 64)
+			if err != nil {
+				return nil, errInvalidTenantSizeArg
+			}
+			sizes[tenantKey(pair[:i])] = size
+		}
+	case map[string]interface{}:
+		for tenant, v := range value {
+			size, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size for tenant %s: %v", tenant, v)
+			}
+			sizes[tenantKey(tenant)] = size
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("invalid tenant sizes: %v", value)
+	}
+	return sizes, nil
+}
+
+type uploadConfig struct {
+	// MaxSize is the maximum size of an upload in bytes. Uploads are not
+	// limited if it is zero.
+	MaxSize int64 `config:"maxSize"`
+	// TenantMaxSizes overrides MaxSize for individual tenants.
+	TenantMaxSizes tenantSizes `config:"tenantMaxSizes"`
+	// DiskReserve is the amount of disk space in bytes which is kept free in
+	// local mode.
+	DiskReserve int64 `config:"diskReserve"`
+}
+
+func (c *uploadConfig) validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("invalid uploads.maxSize: %d", c.MaxSize)
+	}
+	for tenant, size := range c.TenantMaxSizes {
+		if size < 0 {
+			return fmt.Errorf("invalid maximum upload size for tenant %s: %d", tenant, size)
+		}
+	}
+	if c.DiskReserve < 0 {
+		return fmt.Errorf("invalid uploads.diskReserve: %d", c.DiskReserve)
+	}
+	return nil
+}
+
+// uploadPolicy contains the rules the server applies to every upload on top
+// of the constraints requested by the device.
+type uploadPolicy struct {
+	// Overwrite is the overwrite policy used when a bag already exists.
+	Overwrite string
+	// MaxSize is the maximum size of an upload in bytes. Uploads are not
+	// limited if it is zero.
+	MaxSize int64
+	// TenantMaxSizes overrides MaxSize for individual tenants by tenant key.
+	TenantMaxSizes tenantSizes
+}
+
+func uploadPolicyFromConfig(config *configuration) *uploadPolicy {
+	sizes := tenantSizes{}
+	for tenantID, size := range config.Uploads.TenantMaxSizes {
+		sizes[tenantKey(tenantID)] = size
+	}
+	// The tenants section takes precedence over uploads.tenantMaxSizes.
+	for tenantID, t := range config.Tenants {
+		if t.MaxUploadSize != nil {
+			sizes[tenantKey(tenantID)] = *t.MaxUploadSize
+		}
+	}
+	return &uploadPolicy{
+		Overwrite:      config.OverwritePolicy,
+		MaxSize:        config.Uploads.MaxSize,
+		TenantMaxSizes: sizes,
+	}
+}
+
+// maxSize returns the maximum upload size of the tenant or zero if uploads
+// are not limited.
+func (p *uploadPolicy) maxSize(tenantID string) int64 {
+	if size, ok := p.TenantMaxSizes[tenantKey(tenantID)]; ok {
+		return size
+	}
+	return p.MaxSize
+}
+
+// limitSize lowers c.MaxSize to the maximum size of the tenant.
+func (p *uploadPolicy) limitSize(tenantID string, c *uploadConstraints) {
+	if limit := p.maxSize(tenantID); limit > 0 && (c.MaxSize == 0 || c.MaxSize > limit) {
+		c.MaxSize = limit
+	}
+}
+
+// countingReader counts the bytes read from the underlying body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// maxBytesBody is a request body limited with http.MaxBytesReader which
+// reports errUploadTooLarge when the limit is exceeded.
+type maxBytesBody struct {
+	io.ReadCloser
+	body  *countingReader
+	limit int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.body.n > b.limit {
+		err = errUploadTooLarge
+	}
+	return n, err
+}
+
+// limitRequestBody limits the body of r to limit bytes.
+func limitRequestBody(rw http.ResponseWriter, r *http.Request, limit int64) {
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = &maxBytesBody{
+		ReadCloser: http.MaxBytesReader(rw, body, limit),
+		body:       body,
+		limit:      limit,
+	}
+}
+
+// isDiskFull reports whether err was caused by a lack of disk space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, errInsufficientStorage) || errors.Is(err, syscall.ENOSPC)
+}
+
+// freeDiskSpace returns the number of bytes available to unprivileged users
+// on the filesystem containing dir.
+func freeDiskSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// checkFreeSpace returns errInsufficientStorage if storing size more bytes in
+// dir would leave less than reserve bytes of free space. If size is negative
+// only the reserve is checked.
+func checkFreeSpace(dir string, size, reserve int64) error {
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+	if free < uint64(reserve) || free-uint64(reserve) < uint64(size) {
+		return fmt.Errorf("%w: %d bytes available", errInsufficientStorage, free)
+	}
+	return nil
+}
+
+// writeSizeErr writes the response for errors caused by the size of an upload
+// and reports whether err was such an error.
+func writeSizeErr(rw http.ResponseWriter, err error) bool {
+	if errors.Is(err, errUploadTooLarge) {
+		writeErrMsg(rw, http.StatusRequestEntityTooLarge, errUploadTooLarge.Error())
+		return true
+	} else if isDiskFull(err) {
+		logErrorln(err)
+		writeErrMsg(rw, http.StatusInsufficientStorage, "insufficient storage")
+		return true
+	}
+	return false
+}
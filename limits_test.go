@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantSizes(t *testing.T) {
+	var sizes tenantSizes
+	require.Nil(t, sizes.Set("a=10, b=20"))
+	require.Equal(t, tenantSizes{"a": 10, "b": 20}, sizes)
+	require.Equal(t, "a=10,b=20", sizes.String())
+	require.ErrorIs(t, sizes.Set("a"), errInvalidTenantSizeArg)
+	require.ErrorIs(t, sizes.Set("a=b"), errInvalidTenantSizeArg)
+
+	parsed, err := sizes.Parse(map[string]interface{}{"a": 1, "b": "2"})
+	require.Nil(t, err)
+	require.Equal(t, tenantSizes{"a": 1, "b": 2}, parsed)
+	_, err = sizes.Parse(map[string]interface{}{"a": "lots"})
+	require.NotNil(t, err)
+}
+
+func TestUploadPolicyLimitSize(t *testing.T) {
+	p := &uploadPolicy{MaxSize: 100, TenantMaxSizes: tenantSizes{"small": 10, "unlimited": 0}}
+	limit := func(tenantID string, requested int64) int64 {
+		c := uploadConstraints{MaxSize: requested}
+		p.limitSize(tenantID, &c)
+		return c.MaxSize
+	}
+	require.Equal(t, int64(100), limit("other", 0))
+	require.Equal(t, int64(50), limit("other", 50))
+	require.Equal(t, int64(100), limit("other", 500))
+	require.Equal(t, int64(10), limit("small", 50))
+	require.Equal(t, int64(500), limit("unlimited", 500))
+	require.Equal(t, int64(0), limit("unlimited", 0))
+}
+
+func TestLocalUploadLimits(t *testing.T) {
+	backend := &localBackend{
+		Dir:             t.TempDir(),
+		Host:            "http://localhost:9000",
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	handler := receiveUploadHandler(backend, nil)
+	upload := func(t *testing.T, name string, c uploadConstraints, body io.Reader) int {
+		t.Helper()
+		u, err := backend.UploadURL(context.Background(), "test-tenant", "testdevice", name, c)
+		require.Nil(t, err)
+		req := httptest.NewRequest("PUT", u.URL, body)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	deviceDir := filepath.Join(backend.Dir, "test-tenant", "testdevice")
+
+	t.Run("maximum size", func(t *testing.T) {
+		c := uploadConstraints{MaxSize: 5}
+		require.Equal(t, http.StatusOK, upload(t, "a.db3", c, strings.NewReader("hello")))
+		require.Equal(t, http.StatusRequestEntityTooLarge, upload(t, "b.db3", c, strings.NewReader("hello world")))
+		// The size of the body is unknown in advance.
+		require.Equal(t, http.StatusRequestEntityTooLarge, upload(t, "b.db3", c, io.MultiReader(
+			strings.NewReader("hello"), strings.NewReader(" world"),
+		)))
+		_, err := os.Stat(filepath.Join(deviceDir, "b.db3"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("disk reserve", func(t *testing.T) {
+		backend.DiskReserve = 1 << 62
+		defer func() { backend.DiskReserve = 0 }()
+		require.Equal(t, http.StatusInsufficientStorage, upload(t, "c.db3", uploadConstraints{}, strings.NewReader("hello")))
+		_, err := os.Stat(filepath.Join(deviceDir, "c.db3"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
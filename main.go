@@ -2,27 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
 	"github.com/tiiuae/go-configloader"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/cloudiot/v1"
-	"google.golang.org/api/option"
 )
 
 func fmtSprintln(a ...interface{}) string {
@@ -62,20 +60,113 @@ type urlGenerator struct {
 	SigningKey    []byte
 	ValidDuration time.Duration
 	Prefix        string
+	// Scheme is either "v2" or "v4". V2 is used if it is empty.
+	Scheme string
+}
+
+// maxV4ValidDuration is the longest validity period GCS accepts for V4 signed
+// URLs.
+const maxV4ValidDuration = 7 * 24 * time.Hour
+
+// objectPrefix normalizes dataObjectPrefix so that it can be prepended to
+// object names. The result is either empty or ends with a slash.
+func objectPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// objectName returns the name of the object in a bucket where the bag is
+// stored. The same layout is used by all bucket based storage backends.
+func objectName(prefix, tenantID, deviceID, name string) string {
+	return path.Join(prefix+tenantID, deviceID, name)
+}
+
+// ObjectName returns the name of the object in the bucket where the bag is
+// stored.
+func (g *urlGenerator) ObjectName(tenantID, deviceID, name string) string {
+	return objectName(g.Prefix, tenantID, deviceID, name)
 }
 
 func (g *urlGenerator) Generate(tenantID, deviceID, name, method string) (string, error) {
+	return g.generate(tenantID, deviceID, name, method, nil)
+}
+
+// GenerateUpload returns a signed PUT URL which only accepts content matching
+// c.
+func (g *urlGenerator) GenerateUpload(tenantID, deviceID, name string, c uploadConstraints) (*signedURL, error) {
+	headers := map[string]string{}
+	if c.ContentType != "" {
+		headers["Content-Type"] = c.ContentType
+	}
+	if c.ContentMD5 != "" {
+		headers["Content-MD5"] = c.ContentMD5
+	}
+	if c.ContentCRC32C != "" {
+		headers["x-goog-hash"] = "crc32c=" + c.ContentCRC32C
+	}
+	if c.ContentSHA256 != "" {
+		// GCS does not verify SHA-256 hashes but stores the hash in the
+		// object metadata.
+		headers["x-goog-meta-sha256"] = c.ContentSHA256
+	}
+	if c.NoOverwrite {
+		headers["x-goog-if-generation-match"] = "0"
+	}
+	if c.MaxSize > 0 {
+		headers["x-goog-content-length-range"] = "0," + strconv.FormatInt(c.MaxSize, 10)
+	}
+	url, err := g.generate(tenantID, deviceID, name, "PUT", headers)
+	if err != nil {
+		return nil, err
+	}
+	u := &signedURL{URL: url, Expires: timeNow().Add(g.ValidDuration)}
+	if len(headers) > 0 {
+		u.Headers = headers
+	}
+	return u, nil
+}
+
+func (g *urlGenerator) generate(tenantID, deviceID, name, method string, headers map[string]string) (string, error) {
 	if name == "" {
 		name = generateBagName()
 	}
-	name = path.Join(g.Prefix+tenantID, deviceID, name)
-	url, err := storage.SignedURL(g.Bucket, name, &storage.SignedURLOptions{
-		GoogleAccessID: g.Account,
-		PrivateKey:     g.SigningKey,
-		Method:         method,
-		Expires:        timeNow().Add(g.ValidDuration),
-		Scheme:         storage.SigningSchemeV2,
-	})
+	object := g.ObjectName(tenantID, deviceID, name)
+	var (
+		url string
+		err error
+	)
+	if g.Scheme == "v4" {
+		var key *rsa.PrivateKey
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(g.SigningKey)
+		if err == nil {
+			url, err = signGCSV4(
+				key, g.Account, method, g.Bucket, object, headers,
+				timeNow(), g.ValidDuration,
+			)
+		}
+	} else {
+		opts := &storage.SignedURLOptions{
+			GoogleAccessID: g.Account,
+			PrivateKey:     g.SigningKey,
+			Method:         method,
+			Expires:        timeNow().Add(g.ValidDuration),
+			Scheme:         storage.SigningSchemeV2,
+		}
+		for k, v := range headers {
+			switch k {
+			case "Content-Type":
+				opts.ContentType = v
+			case "Content-MD5":
+				opts.MD5 = v
+			default:
+				opts.Headers = append(opts.Headers, k+":"+v)
+			}
+		}
+		url, err = storage.SignedURL(g.Bucket, object, opts)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to generate signed URL: %w", err)
 	}
@@ -87,26 +178,58 @@ func configErr(err error) error {
 }
 
 type configuration struct {
-	Bucket            string        `config:"bucket"`
-	Account           string        `config:"account"`
-	PrivateKeyFile    string        `config:"privateKeyFile"`
-	URLValidDuration  time.Duration `config:"urlValidDuration"`
-	Port              int           `config:"port"`
-	GCP               gcpConfig     `config:"gcp"`
-	LocalDir          string        `config:"fileStorageDirectory"`
-	Host              string        `config:"host"`
-	DataObjectPrefix  string        `config:"dataObjectPrefix"`
-	DisableValidation bool          `config:"disableValidation"`
-	DefaultTenantID   string        `config:"defaultTenantID"`
-	Debug             bool          `config:"debug"`
+	Bucket            string         `config:"bucket"`
+	Account           string         `config:"account"`
+	PrivateKeyFile    string         `config:"privateKeyFile"`
+	URLValidDuration  time.Duration  `config:"urlValidDuration"`
+	Port              int            `config:"port"`
+	GCP               gcpConfig      `config:"gcp"`
+	Registry          registryConfig `config:"deviceRegistry"`
+	Tokens            tokenConfig    `config:"tokens"`
+	S3                s3Config       `config:"s3"`
+	Uploads           uploadConfig   `config:"uploads"`
+	Catalog           catalogConfig  `config:"catalog"`
+	Notifications     notifyConfig   `config:"notifications"`
+	Operators         operatorConfig `config:"operators"`
+	Tenants           tenantConfigs  `config:"tenants"`
+	RateLimits        rateConfig     `config:"rateLimits"`
+	LocalDir          string         `config:"fileStorageDirectory"`
+	LocalSigningKey   string         `config:"fileStorageSigningKey"`
+	StorageBackend    string         `config:"storageBackend"`
+	URLSigningScheme  string         `config:"urlSigningScheme"`
+	OverwritePolicy   string         `config:"overwritePolicy"`
+	Host              string         `config:"host"`
+	DataObjectPrefix  string         `config:"dataObjectPrefix"`
+	DisableValidation bool           `config:"disableValidation"`
+	DefaultTenantID   string         `config:"defaultTenantID"`
+	AdminToken        string         `config:"adminToken"`
+	Debug             bool           `config:"debug"`
 
 	privateKey      []byte
 	jsonCredentials []byte
 }
 
+// storageBackendName returns the name of the configured storage backend. If
+// none is set explicitly, local storage is used when fileStorageDirectory is
+// set and GCS otherwise.
+func (c *configuration) storageBackendName() string {
+	if c.StorageBackend != "" {
+		return c.StorageBackend
+	} else if c.LocalDir != "" {
+		return "local"
+	}
+	return "gcs"
+}
+
 func loadConfig() (config *configuration, err error) {
 	config = &configuration{
 		DefaultTenantID: "fleet-registry",
+		Registry: registryConfig{
+			Cache: registryCacheConfig{
+				TTL:         5 * time.Minute,
+				NegativeTTL: 30 * time.Second,
+			},
+		},
 	}
 	loader := configloader.New()
 	loader.Args = os.Args
@@ -120,7 +243,10 @@ func loadConfig() (config *configuration, err error) {
 		}
 		logErrorln("during config loading:", err)
 	}
-	if config.LocalDir == "" {
+	// GCP credentials are needed for signing GCS URLs and for looking up
+	// device credentials from Cloud IoT.
+	if config.usesStorageBackend("gcs") ||
+		(!config.DisableValidation && config.Registry.typeName() == "cloudiot") {
 		config.jsonCredentials, err = os.ReadFile(config.PrivateKeyFile)
 		if err != nil {
 			return nil, configErr(fmt.Errorf("failed to read private key: %w", err))
@@ -131,6 +257,21 @@ func loadConfig() (config *configuration, err error) {
 		}
 		config.privateKey = keyConfig.PrivateKey
 	}
+	if err := validateOverwritePolicy(config.OverwritePolicy); err != nil {
+		return nil, configErr(err)
+	}
+	if err := config.Uploads.validate(); err != nil {
+		return nil, configErr(err)
+	}
+	if err := config.Tenants.validate(); err != nil {
+		return nil, configErr(err)
+	}
+	if err := config.RateLimits.validate(); err != nil {
+		return nil, configErr(err)
+	}
+	if err := config.Operators.validate(); err != nil {
+		return nil, configErr(err)
+	}
 	if config.Host == "" {
 		config.Host = "http://localhost:" + strconv.Itoa(config.Port)
 	}
@@ -138,17 +279,14 @@ func loadConfig() (config *configuration, err error) {
 }
 
 func urlGeneratorFromConfig(config *configuration) *urlGenerator {
-	g := &urlGenerator{
+	return &urlGenerator{
 		Bucket:        config.Bucket,
 		Account:       config.Account,
 		SigningKey:    config.privateKey,
 		ValidDuration: config.URLValidDuration,
-		Prefix:        strings.Trim(config.DataObjectPrefix, "/"),
-	}
-	if g.Prefix != "" {
-		g.Prefix += "/"
+		Prefix:        objectPrefix(config.DataObjectPrefix),
+		Scheme:        config.URLSigningScheme,
 	}
-	return g
 }
 
 func readAuthJWT(r *http.Request) string {
@@ -164,107 +302,229 @@ func internalServerErr(rw http.ResponseWriter) {
 	writeErrMsg(rw, http.StatusInternalServerError, "something went wrong")
 }
 
-func signedURLGeneratorHandler(config *configuration, gcp gcpAPI) http.Handler {
-	gen := urlGeneratorFromConfig(config)
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		rawToken := readAuthJWT(r)
-		if rawToken == "" {
-			writeErrMsg(rw, http.StatusUnauthorized, "missing or invalid authorization header")
-			return
-		}
-		var (
-			claims *jwtClaims
-			err    error
-		)
-		if config.DisableValidation {
-			claims, err = getClaimsWithoutValidation(rawToken)
-		} else {
-			claims, err = validateJWT(r.Context(), gcp, config.DefaultTenantID, rawToken)
-		}
-		if err != nil {
-			logErrorln(err)
-			writeErrMsg(rw, http.StatusForbidden, "forbidden")
-			return
-		}
-		signedURL, err := gen.Generate(
-			claims.TenantID,
-			claims.DeviceID,
-			claims.BagName,
-			"PUT",
-		)
-		if err != nil {
-			logErrorln(err)
-			internalServerErr(rw)
-			return
+func writeUploadURL(
+	rw http.ResponseWriter,
+	r *http.Request,
+	backend StorageBackend,
+	policy *uploadPolicy,
+	catalog *bagCatalog,
+	claims *jwtClaims,
+) {
+	name, constraints, ok := uploadTarget(rw, r, backend, policy, claims)
+	if !ok {
+		return
+	}
+	uploadURL, err := backend.UploadURL(
+		r.Context(),
+		claims.TenantID,
+		claims.DeviceID,
+		name,
+		constraints,
+	)
+	if err == nil {
+		err = recordIssuedURL(r, catalog, claims, name, uploadURL)
+	}
+	if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	writeJSON(rw, uploadURL)
+}
+
+// deviceHandler handles a request made by a device whose JWT has already been
+// read from the request.
+type deviceHandler func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims)
+
+// tokenReader returns the claims of a raw device JWT.
+type tokenReader func(ctx context.Context, rawToken string) (*jwtClaims, error)
+
+func readTokenWithoutValidation(ctx context.Context, rawToken string) (*jwtClaims, error) {
+	return getClaimsWithoutValidation(rawToken)
+}
+
+// deviceTokenReader returns a tokenReader which validates tokens unless
+// validation is disabled in config. Tokens of tenants which are not allowed
+// are rejected in both cases.
+func deviceTokenReader(config *configuration, validator *tokenValidator) tokenReader {
+	if config.DisableValidation {
+		return func(ctx context.Context, rawToken string) (*jwtClaims, error) {
+			claims, err := readTokenWithoutValidation(ctx, rawToken)
+			if err != nil {
+				return nil, err
+			}
+			// The default tenant is resolved here as in tokenValidator so
+			// that the storage backend and limits of the tenant are used.
+			if claims.TenantID == "" {
+				claims.TenantID = config.DefaultTenantID
+			}
+			if err := config.Tenants.check(claims.TenantID); err != nil {
+				return nil, err
+			}
+			claims.TenantID = config.Tenants.resolve(claims.TenantID)
+			return claims, nil
 		}
-		writeJSON(rw, jsonObj{"url": signedURL})
-	})
+	}
+	return validator.Validate
 }
 
-func localURLGeneratorHandler(host string) http.Handler {
+// logAuthFailure logs why a device token was rejected together with the
+// unverified IDs in the token.
+func logAuthFailure(r *http.Request, rawToken string, err error) {
+	event := log.Warn().Err(err).Str("path", r.URL.Path)
+	if claims, claimsErr := getClaimsWithoutValidation(rawToken); claimsErr == nil {
+		event = event.Str("tenantId", claims.TenantID).Str("deviceId", claims.DeviceID)
+	}
+	event.Msg("device authentication failed")
+}
+
+// authenticateDevice returns a handler which reads the device JWT from the
+// Authorization header and passes its claims to next.
+func authenticateDevice(readToken tokenReader, next deviceHandler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		rawToken := readAuthJWT(r)
 		if rawToken == "" {
 			writeErrMsg(rw, http.StatusUnauthorized, "missing or invalid authorization header")
 			return
 		}
-		claims, err := getClaimsWithoutValidation(rawToken)
+		claims, err := readToken(r.Context(), rawToken)
 		if err != nil {
-			logErrorln(err)
+			logAuthFailure(r, rawToken, err)
+			// The reason is only logged so that it cannot be used to probe
+			// the validation.
 			writeErrMsg(rw, http.StatusForbidden, "forbidden")
 			return
 		}
-		writeJSON(rw, jsonObj{
-			"url": fmt.Sprintf(
-				"%s/upload?tenant=%s&device=%s&bagName=%s",
-				host,
-				url.QueryEscape(claims.TenantID),
-				url.QueryEscape(claims.DeviceID),
-				url.QueryEscape(claims.BagName),
-			),
-		})
+		next(rw, r, claims)
 	})
 }
 
+func uploadURLHandler(backend StorageBackend, policy *uploadPolicy, catalog *bagCatalog) deviceHandler {
+	return func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+		writeUploadURL(rw, r, backend, policy, catalog, claims)
+	}
+}
+
+func signedURLGeneratorHandler(
+	config *configuration,
+	backend StorageBackend,
+	catalog *bagCatalog,
+	validator *tokenValidator,
+	devices *rateLimiter,
+) http.Handler {
+	return authenticateDevice(
+		deviceTokenReader(config, validator),
+		limitDevices(devices, uploadURLHandler(backend, uploadPolicyFromConfig(config), catalog)),
+	)
+}
+
 var pathSegmentSanitizer = strings.NewReplacer("..", "_", "/", "_")
 
-func receiveUploadHandler(dirPath, defaultTenantID string) http.Handler {
+var (
+	errInvalidBagName  = errors.New(`bag names must not contain '/', '\' or '..'`)
+	errReservedBagName = errors.New("bag names must not start with '.'")
+)
+
+// checkBagName rejects names which are not a single path segment, so that
+// bags cannot be stored outside the directory of the device, and names which
+// start with a dot. The latter are reserved for the digests and partial
+// uploads stored next to bags in local mode.
+func checkBagName(name string) error {
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return errInvalidBagName
+	}
+	if strings.HasPrefix(name, ".") {
+		return errReservedBagName
+	}
+	return nil
+}
+
+func receiveUploadHandler(backend *localBackend, catalog *bagCatalog) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		tenant := r.URL.Query().Get("tenant")
-		if tenant == "" {
-			tenant = defaultTenantID
+		if err := backend.verifyURL(r, "/upload"); err != nil {
+			writeErrMsg(rw, http.StatusForbidden, err.Error())
+			return
 		}
+		tenant := r.URL.Query().Get("tenant")
 		device := r.URL.Query().Get("device")
 		if device == "" {
 			writeErrMsg(rw, http.StatusBadRequest, "parameter 'device' is missing")
 			return
 		}
-		dir := filepath.Join(
-			dirPath,
-			pathSegmentSanitizer.Replace(tenant),
-			pathSegmentSanitizer.Replace(device),
-		)
 		//#nosec G301
-		if err := os.MkdirAll(dir, 0o755); err != nil {
+		if err := os.MkdirAll(backend.deviceDir(tenant, device), 0o755); err != nil {
 			logErrorln(err)
 			internalServerErr(rw)
 			return
 		}
-		bagName := pathSegmentSanitizer.Replace(r.URL.Query().Get("bagName"))
+		noOverwrite := r.URL.Query().Get("noOverwrite") != ""
+		declared, err := checksumHeaders(r.Header)
+		if err != nil {
+			writeErrMsg(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		expected := []uploadConstraints{constraintsFromQuery(r), declared}
+		if maxSize := expected[0].MaxSize; maxSize > 0 {
+			if r.ContentLength > maxSize {
+				writeSizeErr(rw, errUploadTooLarge)
+				return
+			}
+			limitRequestBody(rw, r, maxSize)
+		}
+		bagName := r.URL.Query().Get("bagName")
+		if err := checkBagName(bagName); err != nil {
+			writeErrMsg(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		if session := r.URL.Query().Get("session"); session != "" {
+			if bagName == "" {
+				writeErrMsg(rw, http.StatusBadRequest, "parameter 'bagName' is missing")
+				return
+			}
+			receiveResumableUpload(rw, r, backend, catalog, tenant, device, bagName, session, expected, noOverwrite)
+			return
+		}
 		if bagName == "" {
 			bagName = generateBagName()
 		}
-		f, err := os.Create(filepath.Join(dir, bagName))
-		if err != nil {
+		err = checkFreeSpace(backend.deviceDir(tenant, device), r.ContentLength, backend.DiskReserve)
+		if writeSizeErr(rw, err) {
+			return
+		} else if err != nil {
 			logErrorln(err)
 			internalServerErr(rw)
 			return
 		}
-		defer f.Close()
-		if _, err := io.Copy(f, r.Body); err != nil {
+		filePath := backend.filePath(tenant, device, bagName)
+		d := newDigester()
+		var digests *uploadDigests
+		err = writeFileAtomically(filePath, io.TeeReader(r.Body, d), r.ContentLength, func() error {
+			digests = d.Digests()
+			return digests.verify(expected...)
+		}, noOverwrite)
+		if err == nil {
+			err = writeDigests(filePath, digests)
+		}
+		if err == nil {
+			err = catalog.RecordCompleted(r.Context(), tenant, device, bagName, digests)
+		}
+		if writeSizeErr(rw, err) {
+			return
+		} else if errors.Is(err, errObjectExists) {
+			writeErrMsg(rw, http.StatusConflict, "bag already exists")
+			return
+		} else if errors.Is(err, errIncompleteUpload) {
 			logErrorln(err)
 			writeErrMsg(rw, http.StatusBadRequest, "failed to store the file")
 			return
+		} else if errors.Is(err, errDigestMismatch) {
+			logErrorln(err)
+			writeErrMsg(rw, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
 		}
 		rw.WriteHeader(http.StatusOK)
 	})
@@ -291,25 +551,98 @@ func run() int {
 	r.MethodNotAllowedHandler = methodNotAllowedHandler()
 	r.Path("/healthz").Methods("GET").HandlerFunc(healthCheck)
 
-	var urlGenHandler http.Handler
-	if config.LocalDir == "" {
-		config.GCP.iotService, err = cloudiot.NewService(
-			context.Background(),
-			option.WithCredentialsJSON(config.jsonCredentials),
-		)
+	backend, err := storageBackendFromConfig(config)
+	if err != nil {
+		logErrorln(err)
+		return 1
+	}
+	catalog, err := newBagCatalog(config)
+	if err != nil {
+		logErrorln(err)
+		return 1
+	}
+	operators, err := newOperatorAuth(config, catalog)
+	if err != nil {
+		logErrorln(err)
+		return 1
+	}
+	r.Use(authorizeOperators(operators))
+	// Local backends of tenants differ only in the lifetime of the URLs they
+	// sign so any of them can receive uploads.
+	var gcsURLs []*urlGenerator
+	localRoutes := false
+	for _, b := range allStorage(backend) {
+		switch b := b.(type) {
+		case *localBackend:
+			if !localRoutes {
+				r.Path("/upload").Methods("PUT").Handler(receiveUploadHandler(b, catalog))
+				r.Path("/download").Methods("GET").Handler(sendDownloadHandler(b))
+				go b.cleanupSessions(time.Hour)
+				localRoutes = true
+			}
+		case *gcsBackend:
+			gcsURLs = append(gcsURLs, b.gen)
+		}
+	}
+	var registry DeviceRegistry
+	if !config.DisableValidation {
+		registry, err = deviceRegistryFromConfig(config)
 		if err != nil {
 			logErrorln(err)
 			return 1
 		}
-		urlGenHandler = signedURLGeneratorHandler(config, &config.GCP)
-	} else {
-		urlGenHandler = localURLGeneratorHandler(config.Host)
-		r.Path("/upload").Methods("PUT").Handler(receiveUploadHandler(
-			config.LocalDir,
-			config.DefaultTenantID,
-		))
+		if reporter, ok := registry.(registryStatusReporter); ok && operators.enabled() {
+			r.Path("/diagnostics/device-registry").Methods("GET").
+				Name("registryStatus").Handler(registryStatusHandler(reporter))
+		}
+		if cache, ok := registry.(*cachedRegistry); ok && operators.enabled() {
+			r.Path("/admin/credential-cache/{tenant}/{device}").Methods("DELETE").
+				Name("purgeCredentialCache").Handler(purgeCredentialCacheHandler(cache))
+		}
+	}
+	validator, err := newTokenValidator(config, registry)
+	if err != nil {
+		logErrorln(err)
+		return 1
+	}
+	readToken := deviceTokenReader(config, validator)
+	// Clients are limited before their tokens are validated and devices
+	// after it.
+	clientLimiter := newRateLimiter(func(string) rateLimit {
+		return newRateLimit(config.RateLimits.IPRate, config.RateLimits.IPBurst)
+	})
+	deviceLimiter := newRateLimiter(deviceRateLimit(config))
+	r.Path("/generate-url").Methods("POST").Handler(limitClients(
+		clientLimiter,
+		config.RateLimits.clientIP,
+		signedURLGeneratorHandler(config, backend, catalog, validator, deviceLimiter),
+	))
+	r.Path("/generate-resumable-url").Methods("POST").Handler(limitClients(
+		clientLimiter,
+		config.RateLimits.clientIP,
+		authenticateDevice(readToken, limitDevices(
+			deviceLimiter,
+			resumableURLHandler(backend, uploadPolicyFromConfig(config), catalog),
+		)),
+	))
+	if operators.enabled() {
+		r.Path("/tenants/{tenant}/devices/{device}/bags").Methods("GET").
+			Name("listBags").Handler(bagListHandler(backend, catalog))
+		r.Path("/download-url").Methods("POST").
+			Name("downloadURL").Handler(downloadURLHandler(backend))
+		r.Path("/diagnostics/rate-limits").Methods("GET").Name("rateLimitStatus").
+			Handler(rateLimitStatusHandler(clientLimiter, deviceLimiter, config.Tenants.ids()))
+	}
+	if catalog != nil {
+		r.Path("/uploads/{id}/complete").Methods("POST").Handler(
+			authenticateDevice(readToken, uploadCompletionHandler(backend, catalog)),
+		)
+		if len(gcsURLs) > 0 && config.Notifications.Token != "" {
+			r.Path("/notifications/gcs").Methods("POST").Handler(
+				gcsNotificationHandler(gcsURLs, catalog, config.Notifications.Token),
+			)
+		}
 	}
-	r.Path("/generate-url").Methods("POST").Handler(urlGenHandler)
 
 	logInfoln("listening on port", config.Port)
 	_ = http.ListenAndServe(":"+strconv.Itoa(config.Port), r)
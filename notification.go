@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type notifyConfig struct {
+	// Token must be sent in the token query parameter of notification
+	// requests. Notifications are not accepted if it is empty.
+	Token string `config:"token"`
+}
+
+// pubsubPushRequest is the body of a Pub/Sub push request.
+type pubsubPushRequest struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		// Data is decoded from base64 by encoding/json.
+		Data      []byte `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gcsObjectResource contains the fields of a GCS object resource which are
+// needed to record the upload. It is the payload of notifications using the
+// JSON_API_V1 format.
+type gcsObjectResource struct {
+	Bucket   string            `json:"bucket"`
+	Name     string            `json:"name"`
+	Size     int64             `json:"size,string"`
+	MD5Hash  string            `json:"md5Hash"`
+	CRC32C   string            `json:"crc32c"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (o *gcsObjectResource) digests() *uploadDigests {
+	return &uploadDigests{
+		Size:   o.Size,
+		SHA256: o.Metadata["sha256"],
+		MD5:    o.MD5Hash,
+		CRC32C: o.CRC32C,
+	}
+}
+
+var errNotBagObject = errors.New("object is not a bag")
+
+// parseObjectName splits an object name created by objectName into the
+// tenant ID, device ID and bag name.
+func parseObjectName(prefix, name string) (tenantID, deviceID, bagName string, err error) {
+	if !strings.HasPrefix(name, prefix) {
+		return "", "", "", fmt.Errorf("%w: '%s' is outside of the prefix", errNotBagObject, name)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, prefix), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("%w: '%s' is not of the form <tenant>/<device>/<bag>", errNotBagObject, name)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// gcsNotificationHandler records the objects reported by GCS OBJECT_FINALIZE
+// notifications in the catalog. The notifications are received as Pub/Sub
+// push requests and must have a JSON_API_V1 payload containing the size and
+// checksums of the object. Notifications without a valid payload are logged
+// and acknowledged, since redelivering them cannot succeed. Other events and objects outside of the buckets and
+// prefixes are acknowledged and ignored. Objects inside a prefix but outside
+// of the bag layout are recorded as unexpected uploads without tenant and
+// device IDs. gens contains the URL generators of every GCS backend and the
+// object is parsed with the one whose bucket matches and whose prefix is the
+// longest prefix of the object name.
+func gcsNotificationHandler(gens []*urlGenerator, catalog *bagCatalog, token string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+			writeErrMsg(rw, http.StatusForbidden, "forbidden")
+			return
+		}
+		var req pubsubPushRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrMsg(rw, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		attrs := req.Message.Attributes
+		var gen *urlGenerator
+		for _, g := range gens {
+			if g.Bucket == attrs["bucketId"] && strings.HasPrefix(attrs["objectId"], g.Prefix) &&
+				(gen == nil || len(g.Prefix) > len(gen.Prefix)) {
+				gen = g
+			}
+		}
+		if attrs["eventType"] != "OBJECT_FINALIZE" || gen == nil {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Without the payload the upload would be recorded without its size
+		// and checksums. Such notifications are logged and acknowledged
+		// because Pub/Sub would redeliver them until they expire.
+		if attrs["payloadFormat"] != "JSON_API_V1" {
+			logErrorf(
+				"notification %s: unsupported payload format '%s', notifications must use JSON_API_V1",
+				req.Message.MessageID, attrs["payloadFormat"],
+			)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var object gcsObjectResource
+		if err := json.Unmarshal(req.Message.Data, &object); err != nil {
+			logErrorf("notification %s: invalid payload: %v", req.Message.MessageID, err)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		tenantID, deviceID, bagName, err := parseObjectName(gen.Prefix, attrs["objectId"])
+		if err != nil {
+			logWarnf("notification %s: %v", req.Message.MessageID, err)
+			tenantID, deviceID, bagName = "", "", attrs["objectId"]
+		}
+		// Pub/Sub retries the notification if it is not acknowledged.
+		if err := catalog.RecordCompleted(r.Context(), tenantID, deviceID, bagName, object.digests()); err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
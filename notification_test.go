@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseObjectName(t *testing.T) {
+	tenant, device, bag, err := parseObjectName("bags/", "bags/tenant/device/a.db3")
+	require.Nil(t, err)
+	require.Equal(t, []string{"tenant", "device", "a.db3"}, []string{tenant, device, bag})
+	_, _, bag, err = parseObjectName("", "tenant/device/dir/a.db3")
+	require.Nil(t, err)
+	require.Equal(t, "dir/a.db3", bag)
+	for _, name := range []string{"other/tenant/device/a.db3", "bags/tenant/a.db3", "bags/tenant//a.db3"} {
+		_, _, _, err = parseObjectName("bags/", name)
+		require.ErrorIs(t, err, errNotBagObject, name)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	// The notification token must not end up in the access log.
+	u, err := url.Parse("/notifications/gcs?token=secret&x=1")
+	require.Nil(t, err)
+	require.Equal(t, "/notifications/gcs?token=REDACTED&x=1", redactURL(u))
+	u, err = url.Parse("/upload?device=a&bagName=b")
+	require.Nil(t, err)
+	require.Equal(t, "/upload?device=a&bagName=b", redactURL(u))
+}
+
+func TestGCSNotificationHandler(t *testing.T) {
+	catalog := testCatalog(t)
+	gen := &urlGenerator{Bucket: "test-bucket", Prefix: "bags/"}
+	handler := gcsNotificationHandler([]*urlGenerator{gen}, catalog, "secret")
+	recorded, err := os.ReadFile("testdata/gcs-object-finalize.json")
+	require.Nil(t, err)
+	notify := func(t *testing.T, token string, modify func(*pubsubPushRequest)) *httptest.ResponseRecorder {
+		t.Helper()
+		body := recorded
+		if modify != nil {
+			var req pubsubPushRequest
+			require.Nil(t, json.Unmarshal(recorded, &req))
+			modify(&req)
+			body, err = json.Marshal(&req)
+			require.Nil(t, err)
+		}
+		req := httptest.NewRequest("POST", "/notifications/gcs?token="+token, bytes.NewReader(body))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	withObject := func(name string) func(*pubsubPushRequest) {
+		return func(req *pubsubPushRequest) { req.Message.Attributes["objectId"] = name }
+	}
+
+	t.Run("invalid token", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, notify(t, "wrong", nil).Code)
+	})
+	t.Run("issued upload", func(t *testing.T) {
+		issued := &bagUpload{TenantID: "test-tenant", DeviceID: "existing", BagName: "a.db3", IssuedAt: timeNow()}
+		require.Nil(t, catalog.RecordIssued(context.Background(), issued))
+		require.Equal(t, http.StatusNoContent, notify(t, "secret", nil).Code)
+		upload, err := catalog.Get(context.Background(), issued.ID)
+		require.Nil(t, err)
+		require.Equal(t, uploadStatusComplete, upload.Status)
+		require.Equal(t, int64(11), upload.Size)
+		require.Equal(t, helloWorldSHA256, upload.SHA256)
+		require.Equal(t, helloWorldMD5, upload.MD5)
+		require.Equal(t, helloWorldCRC32C, upload.CRC32C)
+
+		// Pub/Sub may deliver the same notification again.
+		require.Equal(t, http.StatusNoContent, notify(t, "secret", nil).Code)
+		require.Len(t, catalogUploads(t, catalog, "a.db3"), 1)
+	})
+	t.Run("unexpected upload", func(t *testing.T) {
+		require.Equal(t, http.StatusNoContent, notify(t, "secret", withObject("bags/test-tenant/existing/b.db3")).Code)
+		uploads := catalogUploads(t, catalog, "b.db3")
+		require.Len(t, uploads, 1)
+		require.Equal(t, uploadStatusUnexpected, uploads[0].Status)
+		require.Equal(t, "test-tenant", uploads[0].TenantID)
+		require.Equal(t, "existing", uploads[0].DeviceID)
+	})
+	t.Run("ignored", func(t *testing.T) {
+		for name, modify := range map[string]func(*pubsubPushRequest){
+			"other event":  func(req *pubsubPushRequest) { req.Message.Attributes["eventType"] = "OBJECT_DELETE" },
+			"other bucket": func(req *pubsubPushRequest) { req.Message.Attributes["bucketId"] = "other" },
+			"other prefix": withObject("other/test-tenant/existing/c.db3"),
+		} {
+			require.Equal(t, http.StatusNoContent, notify(t, "secret", modify).Code, name)
+		}
+		require.Empty(t, catalogUploads(t, catalog, "c.db3"))
+	})
+	t.Run("not a bag", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			require.Equal(t, http.StatusNoContent, notify(t, "secret", withObject("bags/d.db3")).Code)
+		}
+		uploads := catalogUploads(t, catalog, "bags/d.db3")
+		require.Len(t, uploads, 1)
+		require.Equal(t, uploadStatusUnexpected, uploads[0].Status)
+		require.Empty(t, uploads[0].TenantID)
+		require.Empty(t, uploads[0].DeviceID)
+		require.Equal(t, int64(11), uploads[0].Size)
+	})
+	t.Run("invalid payload", func(t *testing.T) {
+		// The notifications are acknowledged so that Pub/Sub does not
+		// redeliver them.
+		resp := notify(t, "secret", func(req *pubsubPushRequest) {
+			req.Message.Attributes["objectId"] = "bags/test-tenant/existing/e.db3"
+			req.Message.Data = []byte("{")
+		})
+		require.Equal(t, http.StatusNoContent, resp.Code)
+		for _, format := range []string{"NONE", ""} {
+			resp = notify(t, "secret", func(req *pubsubPushRequest) {
+				req.Message.Attributes["objectId"] = "bags/test-tenant/existing/e.db3"
+				req.Message.Attributes["payloadFormat"] = format
+			})
+			require.Equal(t, http.StatusNoContent, resp.Code, format)
+		}
+		require.Empty(t, catalogUploads(t, catalog, "e.db3"))
+	})
+}
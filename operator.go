@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type operatorConfig struct {
+	// Issuer is the OpenID Connect issuer of operator tokens. It is required
+	// and the JWKS is discovered from it unless JWKSURL or JWKSFile is set.
+	Issuer string `config:"issuer"`
+	// JWKSURL is the URL of the JWKS of the issuer.
+	JWKSURL string `config:"jwksUrl"`
+	// JWKSFile is a local file containing the JWKS of the issuer.
+	JWKSFile string `config:"jwksFile"`
+	// Audiences contains the accepted values of the aud claim. At least one
+	// is required.
+	Audiences []string `config:"audiences"`
+	// GroupsClaim is the claim listing the groups or roles of the operator.
+	// Nested claims are separated with dots.
+	GroupsClaim string `config:"groupsClaim"`
+	// TenantGroup is the name of the group which grants a role in a tenant.
+	// It is required and must contain the placeholder {tenantId} and can
+	// contain the placeholder {role}.
+	TenantGroup string `config:"tenantGroup"`
+	// DefaultRole is granted by groups if TenantGroup does not contain
+	// {role}.
+	DefaultRole string `config:"defaultRole"`
+	// Roles maps roles to their permissions. defaultOperatorRoles is used if
+	// it is empty.
+	Roles roleConfig `config:"roles"`
+	// ClockSkew is the tolerance used when comparing exp, iat and nbf to the
+	// current time.
+	ClockSkew time.Duration `config:"clockSkew"`
+}
+
+func (c *operatorConfig) enabled() bool {
+	return c.Issuer != "" || c.JWKSURL != "" || c.JWKSFile != ""
+}
+
+// validate returns an error if operator tokens are enabled without the
+// options needed to check that they were issued for this service.
+func (c *operatorConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Issuer == "" {
+		return errors.New("operators.issuer must be set when operator tokens are enabled")
+	}
+	if len(c.Audiences) == 0 {
+		return errors.New("operators.audiences must be set when operator tokens are enabled")
+	}
+	// Groups are not mapped to tenants implicitly because the groups of an
+	// identity provider are often shared with other applications.
+	if c.TenantGroup == "" {
+		return errors.New("operators.tenantGroup must be set when operator tokens are enabled")
+	}
+	if err := c.Roles.validate(); err != nil {
+		return fmt.Errorf("operators.roles: %w", err)
+	}
+	return nil
+}
+
+// operator is an authenticated operator.
+type operator struct {
+	Subject string
+	// Roles contains the roles of the operator by tenant.
+	Roles map[string][]string
+	// RolePermissions maps the roles to their permissions.
+	// defaultOperatorRoles is used if it is empty.
+	RolePermissions roleConfig
+	// AllTenants contains the permissions the operator has in every tenant
+	// regardless of roles. It is set for the admin token.
+	AllTenants []permission
+}
+
+func (o *operator) grant(tenantID, role string) {
+	if o.Roles == nil {
+		o.Roles = map[string][]string{}
+	}
+	for _, r := range o.Roles[tenantID] {
+		if r == role {
+			return
+		}
+	}
+	o.Roles[tenantID] = append(o.Roles[tenantID], role)
+}
+
+func hasPermission(perms []permission, p permission) bool {
+	for _, granted := range perms {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// can reports whether the operator has the permission in the tenant.
+func (o *operator) can(tenantID string, p permission) bool {
+	if hasPermission(o.AllTenants, p) {
+		return true
+	}
+	roles := o.RolePermissions.orDefault()
+	for _, role := range o.Roles[tenantID] {
+		if hasPermission(roles[role], p) {
+			return true
+		}
+	}
+	return false
+}
+
+// canInSomeTenant reports whether the operator has the permission in at least
+// one tenant.
+func (o *operator) canInSomeTenant(p permission) bool {
+	if hasPermission(o.AllTenants, p) {
+		return true
+	}
+	for tenantID := range o.Roles {
+		if o.can(tenantID, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorSigningMethods contains the algorithms accepted in operator tokens.
+var operatorSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// oidcVerifier validates OpenID Connect ID and access tokens of operators.
+type oidcVerifier struct {
+	Keys        *jwksKeySet
+	Issuer      string
+	Audiences   []string
+	GroupsClaim string
+	// TenantGroup matches groups granting a role in a tenant. The tenant ID
+	// is captured in the subexpression "tenant" and the role in "role".
+	TenantGroup *regexp.Regexp
+	// DefaultRole is granted if TenantGroup does not capture the role.
+	DefaultRole string
+	Roles       roleConfig
+	ClockSkew   time.Duration
+}
+
+// tenantGroupPattern converts a group name containing the placeholders
+// {tenantId} and {role} to a regular expression.
+func tenantGroupPattern(group string) (*regexp.Regexp, error) {
+	if strings.Count(group, "{tenantId}") != 1 || strings.Count(group, "{role}") > 1 {
+		return nil, errors.New("operators.tenantGroup must contain {tenantId} exactly once and {role} at most once")
+	}
+	pattern := strings.NewReplacer(
+		regexp.QuoteMeta("{tenantId}"), "(?P<tenant>.+?)",
+		regexp.QuoteMeta("{role}"), "(?P<role>[a-z]+)",
+	).Replace(regexp.QuoteMeta(group))
+	return regexp.Compile("^" + pattern + "$")
+}
+
+func newOIDCVerifier(config *operatorConfig) (*oidcVerifier, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	v := &oidcVerifier{
+		Keys:        &jwksKeySet{},
+		Issuer:      config.Issuer,
+		Audiences:   config.Audiences,
+		GroupsClaim: config.GroupsClaim,
+		DefaultRole: config.DefaultRole,
+		Roles:       config.Roles.orDefault(),
+		ClockSkew:   config.ClockSkew,
+	}
+	switch {
+	case config.JWKSFile != "":
+		v.Keys.Load = jwksFileLoader(config.JWKSFile)
+	case config.JWKSURL != "" || config.Issuer != "":
+		v.Keys.Load = jwksURLLoader(&http.Client{Timeout: 10 * time.Second}, config.Issuer, config.JWKSURL)
+	}
+	if v.GroupsClaim == "" {
+		v.GroupsClaim = "groups"
+	}
+	if v.DefaultRole == "" {
+		v.DefaultRole = "viewer"
+	}
+	if err := v.Roles.validateRole(v.DefaultRole); err != nil {
+		return nil, fmt.Errorf("operators.defaultRole: %w", err)
+	}
+	var err error
+	if v.TenantGroup, err = tenantGroupPattern(config.TenantGroup); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// claimStrings returns the strings in the claim at the dot separated path. A
+// single string is returned as a slice.
+func claimStrings(claims jwt.MapClaims, path string) []string {
+	var value interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		strs := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	default:
+		return nil
+	}
+}
+
+func (v *oidcVerifier) verifyAudience(claims jwt.MapClaims) bool {
+	for _, aud := range v.Audiences {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify validates the token and returns the operator it belongs to.
+func (v *oidcVerifier) Verify(ctx context.Context, rawToken string) (*operator, error) {
+	parser := jwt.Parser{SkipClaimsValidation: true, ValidMethods: operatorSigningMethods}
+	claims := jwt.MapClaims{}
+	token, err := parser.ParseWithClaims(rawToken, claims, func(t *jwt.Token) (interface{}, error) {
+		now := timeNow()
+		if !claims.VerifyExpiresAt(now.Add(-v.ClockSkew).Unix(), true) {
+			return nil, invalidTokenError{errors.New("token has expired")}
+		}
+		if !claims.VerifyIssuedAt(now.Add(v.ClockSkew).Unix(), false) {
+			return nil, invalidTokenError{errors.New("invalid issue date")}
+		}
+		if !claims.VerifyNotBefore(now.Add(v.ClockSkew).Unix(), false) {
+			return nil, invalidTokenError{errors.New("token is not valid yet")}
+		}
+		if !claims.VerifyIssuer(v.Issuer, true) {
+			return nil, invalidTokenError{fmt.Errorf("invalid issuer: %v", claims["iss"])}
+		}
+		if !v.verifyAudience(claims) {
+			return nil, invalidTokenError{fmt.Errorf("invalid audience: %v", claims["aud"])}
+		}
+		kid, _ := t.Header["kid"].(string)
+		return v.Keys.Key(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("failed to validate operator token: %w", err)
+	}
+	op := &operator{RolePermissions: v.Roles}
+	op.Subject, _ = claims["sub"].(string)
+	tenantIdx := v.TenantGroup.SubexpIndex("tenant")
+	roleIdx := v.TenantGroup.SubexpIndex("role")
+	for _, group := range claimStrings(claims, v.GroupsClaim) {
+		m := v.TenantGroup.FindStringSubmatch(group)
+		if m == nil {
+			continue
+		}
+		role := v.DefaultRole
+		if roleIdx >= 0 {
+			role = m[roleIdx]
+		}
+		// Groups of unknown roles may be used by other applications.
+		if _, ok := v.Roles[role]; ok {
+			op.grant(m[tenantIdx], role)
+		}
+	}
+	return op, nil
+}
+
+// adminTokenPermissions are the permissions granted by the admin token in
+// every tenant. The token only exists for purging credentials and is not a
+// substitute for operator roles.
+var adminTokenPermissions = []permission{permPurgeCredential}
+
+// operatorAuth authenticates operators with either the admin token or an
+// OpenID Connect token.
+type operatorAuth struct {
+	AdminToken string
+	// Verifier validates OpenID Connect tokens. They are not accepted if it
+	// is nil.
+	Verifier *oidcVerifier
+	// Catalog contains roles granted to operators in addition to the ones
+	// granted by their groups.
+	Catalog *bagCatalog
+}
+
+func newOperatorAuth(config *configuration, catalog *bagCatalog) (*operatorAuth, error) {
+	auth := &operatorAuth{AdminToken: config.AdminToken, Catalog: catalog}
+	if config.Operators.enabled() {
+		var err error
+		if auth.Verifier, err = newOIDCVerifier(&config.Operators); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// enabled reports whether any operator credentials are accepted.
+func (a *operatorAuth) enabled() bool {
+	return a.AdminToken != "" || a.Verifier != nil
+}
+
+func (a *operatorAuth) authenticate(ctx context.Context, rawToken string) (*operator, error) {
+	if a.AdminToken != "" && subtle.ConstantTimeCompare([]byte(rawToken), []byte(a.AdminToken)) == 1 {
+		return &operator{Subject: "admin", AllTenants: adminTokenPermissions}, nil
+	}
+	if a.Verifier == nil {
+		return nil, errors.New("invalid admin token")
+	}
+	op, err := a.Verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if op.Subject != "" {
+		roles, err := a.Catalog.OperatorRoles(ctx, op.Subject)
+		if err != nil {
+			return nil, err
+		}
+		for tenantID, tenantRoles := range roles {
+			for _, role := range tenantRoles {
+				if err := a.Verifier.Roles.validateRole(role); err != nil {
+					logWarnf("operator '%s' in tenant '%s': %v", op.Subject, tenantID, err)
+					continue
+				}
+				op.grant(tenantID, role)
+			}
+		}
+	}
+	return op, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+type testOperatorKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	jwks []byte
+}
+
+func newTestOperatorKeys(t *testing.T) *testOperatorKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, err := json.Marshal(jsonObj{"keys": []jsonObj{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N), "e": "AQAB"},
+		{"kty": "oct", "kid": "symmetric", "k": "c2VjcmV0"},
+	}})
+	require.Nil(t, err)
+	return &testOperatorKeys{rsa: rsaKey, ec: ecKey, jwks: jwks}
+}
+
+func (k *testOperatorKeys) token(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	base := jwt.MapClaims{
+		"iss": "https://issuer.example.com",
+		"aud": "mdr-backend",
+		"sub": "operator",
+		"iat": timeNow().Unix(),
+		"exp": timeNow().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(base, k)
+		} else {
+			base[k] = v
+		}
+	}
+	var token *jwt.Token
+	var key interface{}
+	if kid == "ec" {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, base), k.ec
+	} else {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, base), k.rsa
+	}
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	require.Nil(t, err)
+	return raw
+}
+
+// newTestOperatorAuth returns operator authentication which accepts tokens
+// signed with keys. The groups "<tenant>:<role>" grant roles.
+func newTestOperatorAuth(t *testing.T, keys *testOperatorKeys) *operatorAuth {
+	t.Helper()
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksFile, keys.jwks, 0o600))
+	v, err := newOIDCVerifier(&operatorConfig{
+		Issuer:      "https://issuer.example.com",
+		JWKSFile:    jwksFile,
+		Audiences:   []string{"mdr-backend"},
+		TenantGroup: "{tenantId}:{role}",
+	})
+	require.Nil(t, err)
+	return &operatorAuth{Verifier: v}
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	keys := newTestOperatorKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksFile, keys.jwks, 0o600))
+	v, err := newOIDCVerifier(&operatorConfig{
+		Issuer:      "https://issuer.example.com",
+		JWKSFile:    jwksFile,
+		Audiences:   []string{"mdr-backend"},
+		TenantGroup: "{tenantId}",
+	})
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	t.Run("groups", func(t *testing.T) {
+		for _, kid := range []string{"rsa", "ec"} {
+			op, err := v.Verify(ctx, keys.token(t, kid, jwt.MapClaims{"groups": []string{"tenant-a", "tenant-b"}}))
+			require.Nil(t, err, kid)
+			require.Equal(t, "operator", op.Subject)
+			require.Equal(t, map[string][]string{"tenant-a": {"viewer"}, "tenant-b": {"viewer"}}, op.Roles)
+			require.True(t, op.can("tenant-a", permListBags))
+			require.False(t, op.can("tenant-a", permPurgeCredential))
+			require.False(t, op.can("tenant-c", permListBags))
+		}
+	})
+	t.Run("nested roles", func(t *testing.T) {
+		v, err := newOIDCVerifier(&operatorConfig{
+			Issuer:      "https://issuer.example.com",
+			JWKSFile:    jwksFile,
+			Audiences:   []string{"mdr-backend"},
+			GroupsClaim: "realm_access.roles",
+			TenantGroup: "mdr-{tenantId}-operator",
+			DefaultRole: "admin",
+		})
+		require.Nil(t, err)
+		op, err := v.Verify(ctx, keys.token(t, "rsa", jwt.MapClaims{
+			"realm_access": jsonObj{"roles": []string{"mdr-tenant-a-operator", "offline_access", "mdr-operator"}},
+		}))
+		require.Nil(t, err)
+		require.Equal(t, map[string][]string{"tenant-a": {"admin"}}, op.Roles)
+	})
+	t.Run("configured roles", func(t *testing.T) {
+		v, err := newOIDCVerifier(&operatorConfig{
+			Issuer:      "https://issuer.example.com",
+			JWKSFile:    jwksFile,
+			Audiences:   []string{"mdr-backend"},
+			TenantGroup: "mdr:{tenantId}:{role}",
+			DefaultRole: "lister",
+			Roles:       roleConfig{"lister": {permListBags}, "diagnostics": {permViewDiagnostics}},
+		})
+		require.Nil(t, err)
+		op, err := v.Verify(ctx, keys.token(t, "rsa", jwt.MapClaims{
+			"groups": []string{"mdr:tenant-a:lister", "mdr:tenant-b:diagnostics", "mdr:tenant-b:admin"},
+		}))
+		require.Nil(t, err)
+		require.Equal(t, map[string][]string{"tenant-a": {"lister"}, "tenant-b": {"diagnostics"}}, op.Roles)
+		require.True(t, op.can("tenant-a", permListBags))
+		require.False(t, op.can("tenant-a", permDownloadBags))
+		require.True(t, op.can("tenant-b", permViewDiagnostics))
+		require.False(t, op.can("tenant-b", permListBags))
+	})
+	t.Run("roles", func(t *testing.T) {
+		v, err := newOIDCVerifier(&operatorConfig{
+			Issuer:      "https://issuer.example.com",
+			JWKSFile:    jwksFile,
+			Audiences:   []string{"mdr-backend"},
+			TenantGroup: "mdr:{tenantId}:{role}",
+		})
+		require.Nil(t, err)
+		op, err := v.Verify(ctx, keys.token(t, "rsa", jwt.MapClaims{
+			"groups": []string{"mdr:tenant-a:admin", "mdr:tenant:b:viewer", "mdr:tenant-a:viewer", "mdr:tenant-c:owner"},
+		}))
+		require.Nil(t, err)
+		require.Equal(t, map[string][]string{"tenant-a": {"admin", "viewer"}, "tenant:b": {"viewer"}}, op.Roles)
+	})
+	t.Run("invalid tokens", func(t *testing.T) {
+		for name, token := range map[string]string{
+			"expired":      keys.token(t, "rsa", jwt.MapClaims{"exp": timeNow().Add(-time.Minute).Unix()}),
+			"no expiry":    keys.token(t, "rsa", jwt.MapClaims{"exp": nil}),
+			"issuer":       keys.token(t, "rsa", jwt.MapClaims{"iss": "https://other.example.com"}),
+			"no issuer":    keys.token(t, "rsa", jwt.MapClaims{"iss": nil}),
+			"audience":     keys.token(t, "rsa", jwt.MapClaims{"aud": "other"}),
+			"no audience":  keys.token(t, "rsa", jwt.MapClaims{"aud": nil}),
+			"unknown key":  keys.token(t, "unknown", nil),
+			"encryption":   keys.token(t, "enc", nil),
+			"wrong key":    newTestOperatorKeys(t).token(t, "rsa", nil),
+			"device token": testGCP().newTestToken("device", "tenant", "", nil),
+		} {
+			_, err := v.Verify(ctx, token)
+			require.Error(t, err, name)
+		}
+	})
+	t.Run("invalid config", func(t *testing.T) {
+		for name, modify := range map[string]func(c *operatorConfig){
+			"tenant group":         func(c *operatorConfig) { c.TenantGroup = "operators" },
+			"default role":         func(c *operatorConfig) { c.DefaultRole = "owner" },
+			"no issuer":            func(c *operatorConfig) { c.Issuer = "" },
+			"no audiences":         func(c *operatorConfig) { c.Audiences = nil },
+			"no tenant group":      func(c *operatorConfig) { c.TenantGroup = "" },
+			"unknown permission":   func(c *operatorConfig) { c.Roles = roleConfig{"viewer": {"bags:upload"}} },
+			"unknown default role": func(c *operatorConfig) { c.Roles = roleConfig{"lister": {permListBags}} },
+		} {
+			config := &operatorConfig{
+				Issuer:      "https://issuer.example.com",
+				JWKSFile:    jwksFile,
+				Audiences:   []string{"mdr-backend"},
+				TenantGroup: "{tenantId}",
+			}
+			modify(config)
+			_, err := newOIDCVerifier(config)
+			require.Error(t, err, name)
+		}
+	})
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	keys := newTestOperatorKeys(t)
+	var jwksRequests int
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, jsonObj{"issuer": server.URL, "jwks_uri": server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		jwksRequests++
+		_, _ = rw.Write(keys.jwks)
+	})
+	v, err := newOIDCVerifier(&operatorConfig{
+		Issuer:      server.URL,
+		Audiences:   []string{"mdr-backend"},
+		TenantGroup: "{tenantId}",
+	})
+	require.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		op, err := v.Verify(context.Background(), keys.token(t, "rsa", jwt.MapClaims{
+			"iss":    server.URL,
+			"groups": "tenant-a",
+		}))
+		require.Nil(t, err)
+		require.True(t, op.can("tenant-a", permListBags))
+	}
+	// Unknown keys cause a reload only after the minimum refresh interval.
+	_, err = v.Verify(context.Background(), keys.token(t, "unknown", jwt.MapClaims{"iss": server.URL}))
+	require.Error(t, err)
+	require.Equal(t, 1, jwksRequests)
+}
+
+func TestJWKSKeySetBackoff(t *testing.T) {
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	now := timeNow()
+	timeNow = func() time.Time { return now }
+
+	keys := newTestOperatorKeys(t)
+	loads, fail := 0, true
+	set := &jwksKeySet{Load: func(context.Context) ([]byte, error) {
+		loads++
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return keys.jwks, nil
+	}}
+	bg := context.Background()
+
+	// Failed loads are not retried before the minimum refresh interval.
+	_, err := set.Key(bg, "rsa")
+	require.Error(t, err)
+	_, err = set.Key(bg, "rsa")
+	require.Error(t, err)
+	require.Equal(t, 1, loads)
+
+	now = now.Add(2 * jwksMinRefreshInterval)
+	fail = false
+	_, err = set.Key(bg, "rsa")
+	require.Nil(t, err)
+	require.Equal(t, 2, loads)
+
+	now = now.Add(2 * jwksMinRefreshInterval)
+	fail = true
+	for _, kid := range []string{"unknown", "other", "rsa"} {
+		_, err = set.Key(bg, kid)
+		require.Equal(t, kid != "rsa", err != nil, kid)
+	}
+	require.Equal(t, 3, loads)
+}
+
+func TestRoleConfig(t *testing.T) {
+	var roles roleConfig
+	parsed, err := roles.Parse(map[string]interface{}{
+		"lister": []interface{}{"bags:list"},
+		"admin":  []interface{}{"bags:list", "credentials:purge"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, roleConfig{
+		"lister": {permListBags},
+		"admin":  {permListBags, permPurgeCredential},
+	}, parsed)
+	require.Nil(t, parsed.(roleConfig).validate())
+
+	require.Nil(t, roles.Set(`{"viewer": ["bags:list", "bags:download"]}`))
+	require.Equal(t, roleConfig{"viewer": {permListBags, permDownloadBags}}, roles)
+	require.Nil(t, roles.Set(roles.String()))
+	require.Equal(t, roleConfig{"viewer": {permListBags, permDownloadBags}}, roles)
+
+	require.Error(t, roles.Set(`viewer`))
+	require.Error(t, roles.Set(`{"viewer": "bags:list"}`))
+	require.Error(t, roleConfig{"viewer": {"bags:upload"}}.validate())
+}
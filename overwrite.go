@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Overwrite policies decide what happens when a device uploads a bag with the
+// same name as an existing one.
+const (
+	// overwritePolicyOverwrite replaces the existing bag.
+	overwritePolicyOverwrite = "overwrite"
+	// overwritePolicyReject refuses to issue a URL for an existing bag and
+	// makes the storage reject uploads which would replace one.
+	overwritePolicyReject = "reject"
+	// overwritePolicySuffix appends a number to the name of the new bag.
+	overwritePolicySuffix = "suffix"
+)
+
+// maxBagNameSuffix is the largest number appended to a bag name with the
+// suffix policy.
+const maxBagNameSuffix = 1000
+
+var errObjectExists = errors.New("object already exists")
+
+func validateOverwritePolicy(policy string) error {
+	switch policy {
+	case "", overwritePolicyOverwrite, overwritePolicyReject, overwritePolicySuffix:
+		return nil
+	default:
+		return fmt.Errorf("unknown overwrite policy: %s", policy)
+	}
+}
+
+// suffixedBagName inserts "-n" before the extensions of name.
+func suffixedBagName(name string, n int) string {
+	suffix := "-" + strconv.Itoa(n)
+	// The first dot is skipped so that hidden files keep their dot.
+	if i := strings.IndexByte(name[1:], '.'); i >= 0 {
+		return name[:i+1] + suffix + name[i+1:]
+	}
+	return name + suffix
+}
+
+// applyOverwritePolicy returns the name the bag should be uploaded with and
+// sets c.NoOverwrite if the storage must not replace an existing object. An
+// empty name is left for the backend to generate. errObjectExists is returned
+// if the bag exists and the policy is to reject it.
+func applyOverwritePolicy(
+	ctx context.Context,
+	backend StorageBackend,
+	policy string,
+	tenantID, deviceID, name string,
+	c *uploadConstraints,
+) (string, error) {
+	if policy == "" || policy == overwritePolicyOverwrite {
+		return name, nil
+	}
+	c.NoOverwrite = true
+	if name == "" {
+		return name, nil
+	}
+	exists := func(name string) (bool, error) {
+		_, err := backend.Stat(ctx, tenantID, deviceID, name)
+		if errors.Is(err, errObjectNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	found, err := exists(name)
+	if err != nil || !found {
+		return name, err
+	}
+	if policy == overwritePolicyReject {
+		return "", errObjectExists
+	}
+	for i := 1; i <= maxBagNameSuffix; i++ {
+		candidate := suffixedBagName(name, i)
+		found, err := exists(candidate)
+		if err != nil || !found {
+			return candidate, err
+		}
+	}
+	return "", fmt.Errorf("%w: no free name found for %s", errObjectExists, name)
+}
+
+// uploadTarget validates the upload constraints of the device, applies the
+// upload policy and chooses a name for the bag if the device did not give one.
+// If the upload cannot be allowed, an error response is written and ok is
+// false.
+func uploadTarget(
+	rw http.ResponseWriter,
+	r *http.Request,
+	backend StorageBackend,
+	policy *uploadPolicy,
+	claims *jwtClaims,
+) (name string, c uploadConstraints, ok bool) {
+	c = claims.uploadConstraints()
+	if err := checkBagName(claims.BagName); err != nil {
+		writeErrMsg(rw, http.StatusBadRequest, err.Error())
+		return "", c, false
+	}
+	if err := c.validate(); err != nil {
+		writeErrMsg(rw, http.StatusBadRequest, err.Error())
+		return "", c, false
+	}
+	policy.limitSize(claims.TenantID, &c)
+	name, err := applyOverwritePolicy(
+		r.Context(), backend, policy.Overwrite, claims.TenantID, claims.DeviceID, claims.BagName, &c,
+	)
+	if errors.Is(err, errObjectExists) {
+		writeErrMsg(rw, http.StatusConflict, "bag already exists")
+		return "", c, false
+	} else if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return "", c, false
+	}
+	if name == "" {
+		name = generateBagName()
+	}
+	return name, c, true
+}
+
+// renameNoReplace moves oldPath to newPath unless newPath exists, in which
+// case errObjectExists is returned. Unlike checking for the file before
+// renaming it, this cannot race with other uploads.
+func renameNoReplace(oldPath, newPath string) error {
+	if err := os.Link(oldPath, newPath); errors.Is(err, os.ErrExist) {
+		return errObjectExists
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuffixedBagName(t *testing.T) {
+	require.Equal(t, "bag-1.db3", suffixedBagName("bag.db3", 1))
+	require.Equal(t, "bag-2.db3.gz", suffixedBagName("bag.db3.gz", 2))
+	require.Equal(t, "bag-3", suffixedBagName("bag", 3))
+	require.Equal(t, ".bag-4", suffixedBagName(".bag", 4))
+}
+
+func TestOverwritePolicy(t *testing.T) {
+	gcp := testGCP()
+	backend := &localBackend{
+		Dir:             t.TempDir(),
+		Host:            "http://localhost:9000",
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	bg := context.Background()
+	deviceDir := filepath.Join(backend.Dir, "test-tenant", "existing")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "a.db3"), []byte("old"), 0o600))
+	require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "a-1.db3"), []byte("old"), 0o600))
+
+	t.Run("policies", func(t *testing.T) {
+		apply := func(policy, name string) (string, bool, error) {
+			var c uploadConstraints
+			name, err := applyOverwritePolicy(bg, backend, policy, "test-tenant", "existing", name, &c)
+			return name, c.NoOverwrite, err
+		}
+		name, noOverwrite, err := apply(overwritePolicyOverwrite, "a.db3")
+		require.Nil(t, err)
+		require.Equal(t, "a.db3", name)
+		require.False(t, noOverwrite)
+
+		_, _, err = apply(overwritePolicyReject, "a.db3")
+		require.ErrorIs(t, err, errObjectExists)
+		name, noOverwrite, err = apply(overwritePolicyReject, "b.db3")
+		require.Nil(t, err)
+		require.Equal(t, "b.db3", name)
+		require.True(t, noOverwrite)
+
+		name, noOverwrite, err = apply(overwritePolicySuffix, "a.db3")
+		require.Nil(t, err)
+		require.Equal(t, "a-2.db3", name)
+		require.True(t, noOverwrite)
+
+		name, noOverwrite, err = apply(overwritePolicySuffix, "")
+		require.Nil(t, err)
+		require.Equal(t, "", name)
+		require.True(t, noOverwrite)
+	})
+	t.Run("conflict response", func(t *testing.T) {
+		handler := authenticateDevice(
+			readTokenWithoutValidation,
+			uploadURLHandler(backend, &uploadPolicy{Overwrite: overwritePolicyReject}, nil),
+		)
+		req := httptest.NewRequest("POST", "/generate-url", nil)
+		req.Header.Add("Authorization", "Bearer "+gcp.newTestToken("existing", "", "a.db3", nil))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusConflict, resp.Code)
+	})
+	t.Run("upload race", func(t *testing.T) {
+		u, err := backend.UploadURL(bg, "test-tenant", "existing", "race.db3", uploadConstraints{NoOverwrite: true})
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "race.db3"), []byte("old"), 0o600))
+		req := httptest.NewRequest("PUT", u.URL, strings.NewReader("new"))
+		resp := httptest.NewRecorder()
+		receiveUploadHandler(backend, nil).ServeHTTP(resp, req)
+		require.Equal(t, http.StatusConflict, resp.Code)
+		data, err := os.ReadFile(filepath.Join(deviceDir, "race.db3"))
+		require.Nil(t, err)
+		require.Equal(t, "old", string(data))
+		entries, err := os.ReadDir(deviceDir)
+		require.Nil(t, err)
+		for _, entry := range entries {
+			require.False(t, strings.HasPrefix(entry.Name(), "."), entry.Name())
+		}
+	})
+	t.Run("storage preconditions", func(t *testing.T) {
+		gen := &urlGenerator{
+			Bucket:        "testbucket",
+			Account:       "testaccount",
+			SigningKey:    gcp.rawPrivateKey,
+			ValidDuration: 5 * time.Minute,
+			Scheme:        "v4",
+		}
+		u, err := gen.GenerateUpload("test-tenant", "existing", "a.db3", uploadConstraints{NoOverwrite: true})
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"x-goog-if-generation-match": "0"}, u.Headers)
+		require.Contains(t, u.URL, "X-Goog-SignedHeaders=host%3Bx-goog-if-generation-match&")
+
+		u, err = testS3Backend("http://minio.local:9000").UploadURL(
+			bg, "test-tenant", "existing", "a.db3", uploadConstraints{NoOverwrite: true},
+		)
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"If-None-Match": "*"}, u.Headers)
+		require.Contains(t, u.URL, "X-Amz-SignedHeaders=host%3Bif-none-match&")
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rateConfig struct {
+	// DeviceRate is the number of URLs per second a device can request on
+	// average. Devices are not limited if it is zero.
+	DeviceRate float64 `config:"deviceRate"`
+	// DeviceBurst is the number of URLs a device can request at once. It
+	// defaults to DeviceRate rounded up.
+	DeviceBurst int `config:"deviceBurst"`
+	// IPRate is the number of URLs per second a client IP address can request
+	// on average. Clients are not limited if it is zero.
+	IPRate float64 `config:"ipRate"`
+	// IPBurst is the number of URLs a client IP address can request at once.
+	// It defaults to IPRate rounded up.
+	IPBurst int `config:"ipBurst"`
+	// ClientIPHeader is the header to which reverse proxies append the
+	// address of their client, such as X-Forwarded-For. The address of the
+	// connection is used if it is empty.
+	ClientIPHeader string `config:"clientIpHeader"`
+	// TrustedProxies is the number of reverse proxies appending to
+	// ClientIPHeader. The address appended by the outermost one is used and
+	// addresses before it are ignored because the client can set them. It
+	// defaults to 1, i.e. the last address is used.
+	TrustedProxies int `config:"trustedProxies"`
+}
+
+func (c *rateConfig) validate() error {
+	if c.DeviceRate < 0 || c.DeviceBurst < 0 {
+		return fmt.Errorf("invalid device rate limit: %v/s, burst %d", c.DeviceRate, c.DeviceBurst)
+	}
+	if c.IPRate < 0 || c.IPBurst < 0 {
+		return fmt.Errorf("invalid IP rate limit: %v/s, burst %d", c.IPRate, c.IPBurst)
+	}
+	if c.TrustedProxies < 0 {
+		return fmt.Errorf("invalid number of trusted proxies: %d", c.TrustedProxies)
+	}
+	return nil
+}
+
+// clientIP returns the address of the client which sent the request. If
+// ClientIPHeader is set, the address appended to it by the outermost trusted
+// proxy is used. Headers with fewer addresses than there are trusted proxies
+// have been written by the proxies alone so their first address is used.
+func (c *rateConfig) clientIP(r *http.Request) string {
+	if c.ClientIPHeader == "" {
+		return clientIP(r)
+	}
+	var addrs []string
+	for _, value := range r.Header.Values(c.ClientIPHeader) {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return clientIP(r)
+	}
+	hops := c.TrustedProxies
+	if hops == 0 {
+		hops = 1
+	}
+	if hops > len(addrs) {
+		hops = len(addrs)
+	}
+	return addrs[len(addrs)-hops]
+}
+
+// rateLimit is the rate at which tokens are added to a bucket and the size of
+// the bucket.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func newRateLimit(rate float64, burst int) rateLimit {
+	if rate > 0 && burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return rateLimit{Rate: rate, Burst: burst}
+}
+
+func (l rateLimit) unlimited() bool {
+	return l.Rate <= 0
+}
+
+// deviceRateLimit returns the per-device rate limit of a tenant.
+func deviceRateLimit(config *configuration) func(tenantID string) rateLimit {
+	return func(tenantID string) rateLimit {
+		rate, burst := config.RateLimits.DeviceRate, config.RateLimits.DeviceBurst
+		if t, ok := config.Tenants.get(tenantID); ok {
+			if t.DeviceRate != nil {
+				rate = *t.DeviceRate
+			}
+			if t.DeviceBurst != nil {
+				burst = *t.DeviceBurst
+			}
+		}
+		return newRateLimit(rate, burst)
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   rateLimit
+}
+
+// refill adds the tokens accumulated since the last update.
+func (b *tokenBucket) refill(now time.Time, limit rateLimit) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	b.limit = limit
+}
+
+func (b *tokenBucket) full() bool {
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// rateLimiterSweepSize is the number of buckets after which full buckets are
+// removed whenever a new bucket is added. A full bucket is equivalent to a
+// missing one. It is also the number of groups after which the counters of
+// groups without buckets are removed whenever a new group is added.
+const rateLimiterSweepSize = 1024
+
+type rateKey struct {
+	group string
+	id    string
+}
+
+// rateCounters counts the requests of a group.
+type rateCounters struct {
+	Allowed  uint64 `json:"allowed"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// rateLimiter limits requests with a token bucket for each ID. IDs are
+// divided into groups which can have different limits.
+type rateLimiter struct {
+	// Limit returns the limit of every ID in the group.
+	Limit func(group string) rateLimit
+
+	mu       sync.Mutex
+	buckets  map[rateKey]*tokenBucket
+	counters map[string]*rateCounters
+}
+
+func newRateLimiter(limit func(group string) rateLimit) *rateLimiter {
+	return &rateLimiter{
+		Limit:    limit,
+		buckets:  map[rateKey]*tokenBucket{},
+		counters: map[string]*rateCounters{},
+	}
+}
+
+// sweep removes full buckets.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(now, b.limit); b.full() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// sweepCounters removes full buckets and the counters of groups which have no
+// buckets left.
+func (l *rateLimiter) sweepCounters(now time.Time) {
+	l.sweep(now)
+	active := map[string]bool{}
+	for key := range l.buckets {
+		active[key.group] = true
+	}
+	for group := range l.counters {
+		if !active[group] {
+			delete(l.counters, group)
+		}
+	}
+}
+
+// Take takes a token from the bucket of the ID. If the bucket is empty, the
+// request is rejected and the time until a token is available is returned.
+func (l *rateLimiter) Take(group, id string) (ok bool, retryAfter time.Duration) {
+	limit := l.Limit(group)
+	if limit.unlimited() {
+		return true, 0
+	}
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := rateKey{group: group, id: id}
+	b, exists := l.buckets[key]
+	if !exists {
+		if len(l.buckets) >= rateLimiterSweepSize {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, limit)
+	c, exists := l.counters[group]
+	if !exists {
+		if len(l.counters) >= rateLimiterSweepSize {
+			l.sweepCounters(now)
+		}
+		c = &rateCounters{}
+		l.counters[group] = c
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		c.Allowed++
+		return true, 0
+	}
+	c.Rejected++
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// rateLimitStatus describes the limit and current usage of a group.
+type rateLimitStatus struct {
+	rateCounters
+	Limit rateLimit `json:"limit"`
+	// Active is the number of IDs whose bucket is not full.
+	Active int `json:"active"`
+	// Throttled is the number of IDs whose bucket is empty.
+	Throttled int `json:"throttled"`
+}
+
+// Status returns the status of every group which has been used and of the
+// given groups.
+func (l *rateLimiter) Status(groups ...string) map[string]*rateLimitStatus {
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := map[string]*rateLimitStatus{}
+	for _, group := range groups {
+		status[group] = &rateLimitStatus{Limit: l.Limit(group)}
+	}
+	for group, c := range l.counters {
+		if _, ok := status[group]; !ok {
+			status[group] = &rateLimitStatus{Limit: l.Limit(group)}
+		}
+		status[group].rateCounters = *c
+	}
+	l.sweep(now)
+	for key, b := range l.buckets {
+		s := status[key.group]
+		s.Active++
+		if b.tokens < 1 {
+			s.Throttled++
+		}
+	}
+	return status
+}
+
+// writeRateLimited responds to a request rejected by a rate limiter.
+func writeRateLimited(rw http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeErrMsg(rw, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// limitClients returns a handler which rate limits requests by the client IP
+// address returned by clientIP before passing them to next.
+func limitClients(limiter *rateLimiter, clientIP func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, retryAfter := limiter.Take("", ip); !ok {
+			logWarnf("rate limit exceeded for client %s", ip)
+			writeRateLimited(rw, retryAfter)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// limitDevices returns a handler which rate limits requests by device before
+// passing them to next. The tenant keys are used as groups so that they match
+// the configured tenants. Devices are not limited if limiter is nil.
+func limitDevices(limiter *rateLimiter, next deviceHandler) deviceHandler {
+	if limiter == nil {
+		return next
+	}
+	return func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+		if ok, retryAfter := limiter.Take(tenantKey(claims.TenantID), claims.DeviceID); !ok {
+			logWarnf("rate limit exceeded for device '%s/%s'", claims.TenantID, claims.DeviceID)
+			writeRateLimited(rw, retryAfter)
+			return
+		}
+		next(rw, r, claims)
+	}
+}
+
+// rateLimitStatusHandler reports the limits and usage of the client and device
+// rate limiters. The status of devices is grouped by tenant and only includes
+// the tenants in which the operator can view diagnostics.
+func rateLimitStatusHandler(clients, devices *rateLimiter, tenantIDs []string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		op := operatorFromContext(r.Context())
+		tenants := devices.Status(tenantIDs...)
+		for tenantID := range tenants {
+			if op == nil || !op.can(tenantID, permViewDiagnostics) {
+				delete(tenants, tenantID)
+			}
+		}
+		writeJSON(rw, jsonObj{
+			"clients": clients.Status("")[""],
+			"devices": jsonObj{
+				"limit":   devices.Limit(""),
+				"tenants": tenants,
+			},
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	now := timeNow()
+	timeNow = func() time.Time { return now }
+
+	rate, burst := 0.5, 1
+	config := &configuration{
+		RateLimits: rateConfig{DeviceRate: 1, DeviceBurst: 2},
+		Tenants: tenantConfigs{
+			"slow":      {Enabled: true, DeviceRate: &rate, DeviceBurst: &burst},
+			"unlimited": {Enabled: true, DeviceRate: new(float64)},
+		},
+	}
+	l := newRateLimiter(deviceRateLimit(config))
+	take := func(group, id string) time.Duration {
+		ok, retryAfter := l.Take(group, id)
+		require.Equal(t, ok, retryAfter == 0)
+		return retryAfter
+	}
+
+	require.Zero(t, take("tenant", "a"))
+	require.Zero(t, take("tenant", "a"))
+	require.Equal(t, time.Second, take("tenant", "a"))
+	require.Zero(t, take("tenant", "b"))
+	now = now.Add(500 * time.Millisecond)
+	require.Equal(t, 500*time.Millisecond, take("tenant", "a"))
+	now = now.Add(500 * time.Millisecond)
+	require.Zero(t, take("tenant", "a"))
+
+	require.Zero(t, take("slow", "a"))
+	require.Equal(t, 2*time.Second, take("slow", "a"))
+	require.Equal(t, rateLimit{Rate: 0.5, Burst: 1}, l.Limit("Slow"))
+	for i := 0; i < 10; i++ {
+		require.Zero(t, take("unlimited", "a"))
+	}
+
+	status := l.Status("idle")
+	require.Equal(t, map[string]*rateLimitStatus{
+		"tenant": {
+			rateCounters: rateCounters{Allowed: 4, Rejected: 2},
+			Limit:        rateLimit{Rate: 1, Burst: 2},
+			Active:       1,
+			Throttled:    1,
+		},
+		"slow": {
+			rateCounters: rateCounters{Allowed: 1, Rejected: 1},
+			Limit:        rateLimit{Rate: 0.5, Burst: 1},
+			Active:       1,
+			Throttled:    1,
+		},
+		"idle": {Limit: rateLimit{Rate: 1, Burst: 2}},
+	}, status)
+
+	// Full buckets are removed.
+	now = now.Add(time.Minute)
+	require.Equal(t, 0, l.Status()["tenant"].Active)
+	require.Empty(t, l.buckets)
+}
+
+func TestRateLimitHandlers(t *testing.T) {
+	clients := newRateLimiter(func(string) rateLimit { return newRateLimit(1, 0) })
+	devices := newRateLimiter(func(string) rateLimit { return newRateLimit(0.1, 0) })
+	ipConfig := &rateConfig{ClientIPHeader: "X-Forwarded-For"}
+	handler := limitClients(clients, ipConfig.clientIP, authenticateDevice(
+		readTokenWithoutValidation,
+		limitDevices(devices, func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+			rw.WriteHeader(http.StatusNoContent)
+		}),
+	))
+	gcp := testGCP()
+	request := func(remoteAddr, forwardedFor, device string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate-url", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if device != "" {
+			req.Header.Set("Authorization", "Bearer "+gcp.newTestToken(device, "tenant", "", nil))
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	require.Equal(t, http.StatusUnauthorized, request("10.0.0.1:1234", "", "").Code)
+	resp := request("10.0.0.1:1234", "", "a")
+	require.Equal(t, http.StatusTooManyRequests, resp.Code)
+	require.Equal(t, "1", resp.Header().Get("Retry-After"))
+	require.JSONEq(t, `{"error": "rate limit exceeded"}`, resp.Body.String())
+
+	// The first address is set by the client and ignored.
+	require.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:1234", "192.0.2.1, 10.0.0.1", "a").Code)
+	require.Equal(t, http.StatusNoContent, request("10.0.0.1:1234", "10.0.0.1, 192.0.2.1", "a").Code)
+	resp = request("10.0.0.1:1234", "192.0.2.2", "a")
+	require.Equal(t, http.StatusTooManyRequests, resp.Code)
+	require.Equal(t, "10", resp.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusNoContent, request("10.0.0.1:1234", "192.0.2.3", "b").Code)
+
+	type rateStatus struct {
+		Clients *rateLimitStatus
+		Devices struct {
+			Limit   rateLimit
+			Tenants map[string]*rateLimitStatus
+		}
+	}
+	getStatus := func(op *operator) (status rateStatus) {
+		req := httptest.NewRequest("GET", "/diagnostics/rate-limits", nil)
+		req = req.WithContext(context.WithValue(req.Context(), operatorContextKey{}, op))
+		statusResp := httptest.NewRecorder()
+		rateLimitStatusHandler(clients, devices, []string{"other"}).ServeHTTP(statusResp, req)
+		require.Nil(t, json.NewDecoder(statusResp.Body).Decode(&status))
+		return status
+	}
+	// Only the tenants in which the operator can view diagnostics are
+	// included.
+	status := getStatus(&operator{Roles: map[string][]string{"tenant": {"viewer"}}})
+	require.Empty(t, status.Devices.Tenants)
+	status = getStatus(&operator{Roles: map[string][]string{"tenant": {"admin"}}})
+	require.Len(t, status.Devices.Tenants, 1)
+	require.Equal(t, rateCounters{Allowed: 4, Rejected: 2}, status.Clients.rateCounters)
+	require.Equal(t, rateLimit{Rate: 0.1, Burst: 1}, status.Devices.Limit)
+	require.Equal(t, rateCounters{Allowed: 2, Rejected: 1}, status.Devices.Tenants["tenant"].rateCounters)
+	require.Equal(t, 2, status.Devices.Tenants["tenant"].Active)
+	require.Equal(t, 2, status.Devices.Tenants["tenant"].Throttled)
+
+	t.Run("authorization", func(t *testing.T) {
+		r := mux.NewRouter()
+		r.Use(authorizeOperators(&operatorAuth{}))
+		r.Path("/diagnostics/rate-limits").Name("rateLimitStatus").
+			Handler(rateLimitStatusHandler(clients, devices, nil))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest("GET", "/diagnostics/rate-limits", nil))
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+	})
+}
+
+func TestLimitDevicesTenantCase(t *testing.T) {
+	devices := newRateLimiter(func(string) rateLimit { return newRateLimit(0.1, 0) })
+	handler := limitDevices(devices, func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	take := func(tenantID string) int {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest("POST", "/generate-url", nil), &jwtClaims{TenantID: tenantID, DeviceID: "a"})
+		return resp.Code
+	}
+	// Tenant IDs differing in case share the bucket and the status group.
+	require.Equal(t, http.StatusNoContent, take("ACME"))
+	require.Equal(t, http.StatusTooManyRequests, take("acme"))
+	status := devices.Status("acme")
+	require.Len(t, status, 1)
+	require.Equal(t, rateCounters{Allowed: 1, Rejected: 1}, status["acme"].rateCounters)
+}
+
+func TestRateLimiterCounterPruning(t *testing.T) {
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	now := timeNow()
+	timeNow = func() time.Time { return now }
+
+	l := newRateLimiter(func(string) rateLimit { return newRateLimit(1, 0) })
+	for i := 0; i < rateLimiterSweepSize+10; i++ {
+		ok, _ := l.Take(strconv.Itoa(i), "device")
+		require.True(t, ok)
+		// The buckets of earlier groups are full again when later groups
+		// are added.
+		now = now.Add(time.Minute)
+	}
+	require.LessOrEqual(t, len(l.counters), rateLimiterSweepSize)
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		header         string
+		trustedProxies int
+		values         []string
+		expected       string
+	}{
+		{"", 0, []string{"192.0.2.1"}, "10.0.0.1"},
+		{"X-Forwarded-For", 0, nil, "10.0.0.1"},
+		{"X-Forwarded-For", 0, []string{"192.0.2.1"}, "192.0.2.1"},
+		{"X-Forwarded-For", 1, []string{"192.0.2.1, 192.0.2.2"}, "192.0.2.2"},
+		{"X-Forwarded-For", 2, []string{"192.0.2.1, 192.0.2.2, 10.0.0.2"}, "192.0.2.2"},
+		{"X-Forwarded-For", 2, []string{"192.0.2.1", "192.0.2.2, 10.0.0.2"}, "192.0.2.2"},
+		{"X-Forwarded-For", 3, []string{"192.0.2.2, 10.0.0.2"}, "192.0.2.2"},
+		{"X-Real-Ip", 0, []string{"192.0.2.3"}, "192.0.2.3"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, value := range tc.values {
+			req.Header.Add(tc.header, value)
+			if tc.header == "" {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+		}
+		config := &rateConfig{ClientIPHeader: tc.header, TrustedProxies: tc.trustedProxies}
+		require.Equal(t, tc.expected, config.clientIP(req), "%+v", tc)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// permission is an action an operator can be allowed to perform on the bags
+// and devices of a tenant.
+type permission string
+
+const (
+	permListBags        permission = "bags:list"
+	permDownloadBags    permission = "bags:download"
+	permPurgeCredential permission = "credentials:purge"
+	permViewDiagnostics permission = "diagnostics:view"
+)
+
+// permissions contains every permission which can be granted.
+var permissions = []permission{permListBags, permDownloadBags, permPurgeCredential, permViewDiagnostics}
+
+// roleConfig maps the roles which can be granted to operators to their
+// permissions. It can be given as a map of lists in the configuration file or
+// as a JSON object in flags and environment variables.
+type roleConfig map[string][]permission
+
+// defaultOperatorRoles are the roles used if operators.roles is not set.
+// There is no uploader role because bags are only uploaded by devices, with
+// URLs issued for their own tokens.
+var defaultOperatorRoles = roleConfig{
+	"viewer": {permListBags, permDownloadBags},
+	"admin":  {permListBags, permDownloadBags, permPurgeCredential, permViewDiagnostics},
+}
+
+func (c *roleConfig) String() string {
+	if len(*c) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(*c)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (c *roleConfig) Set(value string) error {
+	parsed, err := c.Parse(value)
+	if err != nil {
+		return err
+	}
+	*c = parsed.(roleConfig)
+	return nil
+}
+
+func (c *roleConfig) Type() string {
+	return "roles"
+}
+
+// Parse implements configloader.Option.
+func (c *roleConfig) Parse(value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok {
+		if strings.TrimSpace(s) == "" {
+			return roleConfig{}, nil
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &obj); err != nil {
+			return nil, fmt.Errorf("roles must be given as a JSON object: %w", err)
+		}
+		value = obj
+	}
+	roles := roleConfig{}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for role, v := range value {
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("permissions of role %s must be a list: %v", role, v)
+			}
+			perms := make([]permission, 0, len(list))
+			for _, p := range list {
+				perms = append(perms, permission(fmt.Sprint(p)))
+			}
+			roles[role] = perms
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("invalid roles: %v", value)
+	}
+	return roles, nil
+}
+
+func (c roleConfig) validate() error {
+	for role, perms := range c {
+		for _, p := range perms {
+			if !knownPermission(p) {
+				return fmt.Errorf("unknown permission of role %s: %s", role, p)
+			}
+		}
+	}
+	return nil
+}
+
+func knownPermission(p permission) bool {
+	for _, known := range permissions {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// orDefault returns the default roles if c is empty.
+func (c roleConfig) orDefault() roleConfig {
+	if len(c) == 0 {
+		return defaultOperatorRoles
+	}
+	return c
+}
+
+func (c roleConfig) validateRole(role string) error {
+	if _, ok := c[role]; !ok {
+		roles := make([]string, 0, len(c))
+		for r := range c {
+			roles = append(roles, r)
+		}
+		sort.Strings(roles)
+		return fmt.Errorf("invalid role '%s', must be one of %v", role, roles)
+	}
+	return nil
+}
+
+// routePermissions contains the permissions required by operator routes by
+// route name. Routes which are not listed are not checked by
+// authorizeOperators.
+var routePermissions = map[string]permission{
+	"listBags":             permListBags,
+	"downloadURL":          permDownloadBags,
+	"purgeCredentialCache": permPurgeCredential,
+	"rateLimitStatus":      permViewDiagnostics,
+	"registryStatus":       permViewDiagnostics,
+}
+
+type operatorContextKey struct{}
+
+// operatorFromContext returns the operator authenticated by
+// authorizeOperators.
+func operatorFromContext(ctx context.Context) *operator {
+	op, _ := ctx.Value(operatorContextKey{}).(*operator)
+	return op
+}
+
+// writePermissionDenied responds to requests the operator does not have the
+// permission for. The missing permission is included in the response. tenantID
+// is empty if the permission is not granted for any tenant.
+func writePermissionDenied(rw http.ResponseWriter, tenantID string, p permission) {
+	resp := jsonObj{"permission": p}
+	if tenantID == "" {
+		resp["error"] = fmt.Sprintf("missing permission %s", p)
+	} else {
+		resp["error"] = fmt.Sprintf("missing permission %s for tenant '%s'", p, tenantID)
+		resp["tenantId"] = tenantID
+	}
+	rw.WriteHeader(http.StatusForbidden)
+	writeJSON(rw, resp)
+}
+
+// authorizeOperators is a middleware which authenticates operators on the
+// routes listed in routePermissions and checks that they have the permission
+// required by the route. If the route has a tenant variable, the permission
+// must be granted for that tenant. Otherwise it must be granted for some
+// tenant and the handler has to check it for the tenant in the request. The
+// operator is stored in the request context.
+func authorizeOperators(auth *operatorAuth) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			required, ok := routePermissions[route.GetName()]
+			if !ok {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			rawToken := readAuthJWT(r)
+			if rawToken == "" {
+				writeErrMsg(rw, http.StatusUnauthorized, "missing or invalid authorization header")
+				return
+			}
+			op, err := auth.authenticate(r.Context(), rawToken)
+			if err != nil {
+				log.Warn().Err(err).Str("path", r.URL.Path).Msg("operator authentication failed")
+				writeErrMsg(rw, http.StatusForbidden, "forbidden")
+				return
+			}
+			if tenantID, ok := mux.Vars(r)["tenant"]; ok {
+				if !op.can(tenantID, required) {
+					writePermissionDenied(rw, tenantID, required)
+					return
+				}
+			} else if !op.canInSomeTenant(required) {
+				writePermissionDenied(rw, "", required)
+				return
+			}
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), operatorContextKey{}, op)))
+		})
+	}
+}
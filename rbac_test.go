@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeOperators(t *testing.T) {
+	keys := newTestOperatorKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksFile, keys.jwks, 0o600))
+	v, err := newOIDCVerifier(&operatorConfig{
+		Issuer:      "https://issuer.example.com",
+		JWKSFile:    jwksFile,
+		Audiences:   []string{"mdr-backend"},
+		TenantGroup: "{tenantId}",
+	})
+	require.Nil(t, err)
+	catalog := testCatalog(t)
+	_, err = catalog.db.Exec(`INSERT INTO operator_roles (subject, tenant_id, role)
+VALUES ('operator', 'tenant-b', 'admin'), ('operator', 'tenant-c', 'owner')`)
+	require.Nil(t, err)
+	backend := &localBackend{
+		Dir:           t.TempDir(),
+		Host:          "http://localhost:9000",
+		SigningKey:    []byte("secret"),
+		ValidDuration: 5 * time.Minute,
+	}
+	deviceDir := filepath.Join(backend.Dir, "tenant-b", "device")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	require.Nil(t, os.WriteFile(filepath.Join(deviceDir, "a.db3"), []byte("hello world"), 0o600))
+
+	r := mux.NewRouter()
+	r.Use(authorizeOperators(&operatorAuth{AdminToken: "admin-token", Verifier: v, Catalog: catalog}))
+	r.Path("/tenants/{tenant}/devices/{device}/bags").Methods("GET").
+		Name("listBags").Handler(bagListHandler(backend, catalog))
+	r.Path("/download-url").Methods("POST").
+		Name("downloadURL").Handler(downloadURLHandler(backend))
+	r.Path("/healthz").Methods("GET").HandlerFunc(healthCheck)
+
+	viewer := "Bearer " + keys.token(t, "rsa", jwt.MapClaims{"groups": []string{"tenant-a"}})
+	do := func(method, path, auth, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("unprotected route", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do("GET", "/healthz", "", "").Code)
+	})
+	t.Run("authentication", func(t *testing.T) {
+		resp := do("GET", "/tenants/tenant-a/devices/device/bags", "", "")
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		resp = do("GET", "/tenants/tenant-a/devices/device/bags", "Bearer wrong", "")
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.JSONEq(t, `{"error": "forbidden"}`, resp.Body.String())
+	})
+	t.Run("tenant route", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do("GET", "/tenants/tenant-a/devices/device/bags", viewer, "").Code)
+		require.Equal(t, http.StatusOK, do("GET", "/tenants/tenant-b/devices/device/bags", viewer, "").Code)
+		resp := do("GET", "/tenants/tenant-c/devices/device/bags", viewer, "")
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.JSONEq(t, `{
+			"error": "missing permission bags:list for tenant 'tenant-c'",
+			"permission": "bags:list",
+			"tenantId": "tenant-c"
+		}`, resp.Body.String())
+	})
+	t.Run("tenant in body", func(t *testing.T) {
+		resp := do("POST", "/download-url", viewer, `{"tenantId": "tenant-c", "deviceId": "device", "bagName": "a.db3"}`)
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.JSONEq(t, `{
+			"error": "missing permission bags:download for tenant 'tenant-c'",
+			"permission": "bags:download",
+			"tenantId": "tenant-c"
+		}`, resp.Body.String())
+
+		resp = do("POST", "/download-url", viewer, `{"tenantId": "tenant-b", "deviceId": "device", "bagName": "a.db3"}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.Contains(t, resp.Body.String(), "tenant=tenant-b")
+	})
+	t.Run("no tenant", func(t *testing.T) {
+		other := "Bearer " + keys.token(t, "rsa", jwt.MapClaims{"sub": "other", "groups": []string{}})
+		resp := do("POST", "/download-url", other, `{"tenantId": "tenant-a", "deviceId": "device", "bagName": "a.db3"}`)
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.JSONEq(t, `{
+			"error": "missing permission bags:download",
+			"permission": "bags:download"
+		}`, resp.Body.String())
+	})
+	t.Run("admin token", func(t *testing.T) {
+		// The admin token only grants the permission to purge credentials.
+		resp := do("GET", "/tenants/tenant-a/devices/device/bags", "Bearer admin-token", "")
+		require.Equal(t, http.StatusForbidden, resp.Code)
+		require.JSONEq(t, `{
+			"error": "missing permission bags:list for tenant 'tenant-a'",
+			"permission": "bags:list",
+			"tenantId": "tenant-a"
+		}`, resp.Body.String())
+		op, err := (&operatorAuth{AdminToken: "admin-token"}).authenticate(context.Background(), "admin-token")
+		require.Nil(t, err)
+		require.True(t, op.can("tenant-a", permPurgeCredential))
+		require.False(t, op.canInSomeTenant(permViewDiagnostics))
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // Registers the postgres driver.
+	"google.golang.org/api/cloudiot/v1"
+	"google.golang.org/api/option"
+	_ "modernc.org/sqlite" // Registers the sqlite driver.
+)
+
+// DeviceRegistry provides the public keys devices use to sign their JWTs.
+type DeviceRegistry interface {
+	// GetDeviceCredentials returns the credentials of a device. An error is
+	// returned if the device does not exist.
+	GetDeviceCredentials(ctx context.Context, tenantID, deviceID string) ([]*deviceCredential, error)
+}
+
+// deviceCredential has the same structure as cloudiot.DeviceCredential so
+// existing credentials can be reused as is.
+type deviceCredential struct {
+	// ExpirationTime is in RFC3339 format. Credentials which never expire
+	// have an expiration time equal to Unix zero time.
+	ExpirationTime string               `json:"expirationTime" yaml:"expirationTime"`
+	PublicKey      *publicKeyCredential `json:"publicKey" yaml:"publicKey"`
+}
+
+type publicKeyCredential struct {
+	Format string `json:"format" yaml:"format"`
+	Key    string `json:"key" yaml:"key"`
+}
+
+// nonExpiringTime is the expiration time of credentials which never expire.
+var nonExpiringTime = time.Unix(0, 0).UTC().Format(time.RFC3339)
+
+type unknownDeviceError struct {
+	TenantID, DeviceID string
+}
+
+func (err unknownDeviceError) Error() string {
+	return fmt.Sprintf("unknown device: %s/%s", err.TenantID, err.DeviceID)
+}
+
+// deviceKey identifies a device in maps containing the devices of every
+// tenant.
+type deviceKey struct {
+	TenantID, DeviceID string
+}
+
+// checkDeviceIDs returns an error if the tenant or device ID is empty, is "."
+// or contains "/" or "..". Such IDs could refer to another device once they
+// are joined into a path.
+func checkDeviceIDs(tenantID, deviceID string) error {
+	for _, id := range []string{tenantID, deviceID} {
+		if id == "" || id == "." || strings.Contains(id, "/") || strings.Contains(id, "..") {
+			return fmt.Errorf("invalid tenant or device ID: %q/%q", tenantID, deviceID)
+		}
+	}
+	return nil
+}
+
+type registryConfig struct {
+	// Type is the name of the registry implementation. Cloud IoT is used if
+	// it is empty.
+	Type  string              `config:"type"`
+	File  string              `config:"file"`
+	SQL   sqlRegistryConfig   `config:"sql"`
+	HTTP  httpRegistryConfig  `config:"http"`
+	Cache registryCacheConfig `config:"cache"`
+}
+
+type deviceRegistryFactory func(config *configuration) (DeviceRegistry, error)
+
+// deviceRegistries contains all available device registries by the name used
+// to select them in the configuration.
+var deviceRegistries = map[string]deviceRegistryFactory{
+	"cloudiot": newCloudIoTRegistry,
+	"file":     newFileRegistry,
+	"sql":      newSQLRegistry,
+	"http":     newHTTPRegistry,
+}
+
+func (c *registryConfig) typeName() string {
+	if c.Type == "" {
+		return "cloudiot"
+	}
+	return c.Type
+}
+
+func deviceRegistryFromConfig(config *configuration) (DeviceRegistry, error) {
+	newRegistry, ok := deviceRegistries[config.Registry.typeName()]
+	if !ok {
+		return nil, fmt.Errorf("unknown device registry: %s", config.Registry.Type)
+	}
+	registry, err := newRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+	// The file registry is already kept in memory and caching it would only
+	// delay reloads.
+	if config.Registry.Cache.TTL > 0 && config.Registry.typeName() != "file" {
+		registry = newCachedRegistry(registry, config.Registry.Cache)
+	}
+	return registry, nil
+}
+
+// registryStatusReporter is implemented by device registries which can report
+// diagnostic information about their state.
+type registryStatusReporter interface {
+	Status() jsonObj
+}
+
+func registryStatusHandler(registry registryStatusReporter) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, registry.Status())
+	}
+}
+
+type gcpConfig struct {
+	ProjectID  string `config:"projectId"`
+	Region     string `config:"region"`
+	iotService *cloudiot.Service
+}
+
+// newCloudIoTRegistry returns a registry backed by Cloud IoT Core. It is kept
+// for existing deployments and uses the registry named after the tenant.
+func newCloudIoTRegistry(config *configuration) (DeviceRegistry, error) {
+	var err error
+	config.GCP.iotService, err = cloudiot.NewService(
+		context.Background(),
+		option.WithCredentialsJSON(config.jsonCredentials),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &config.GCP, nil
+}
+
+func (g *gcpConfig) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	device, err := g.iotService.Projects.Locations.Registries.Devices.Get(
+		fmt.Sprintf(
+			"projects/%s/locations/%s/registries/%s/devices/%s",
+			g.ProjectID, g.Region, tenantID, deviceID,
+		),
+	).Context(ctx).FieldMask("credentials").Do()
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]*deviceCredential, 0, len(device.Credentials))
+	for _, cred := range device.Credentials {
+		c := &deviceCredential{ExpirationTime: cred.ExpirationTime}
+		if cred.PublicKey != nil {
+			c.PublicKey = &publicKeyCredential{
+				Format: cred.PublicKey.Format,
+				Key:    cred.PublicKey.Key,
+			}
+		}
+		creds = append(creds, c)
+	}
+	return creds, nil
+}
+
+type sqlRegistryConfig struct {
+	// Driver is either "postgres" or "sqlite".
+	Driver string `config:"driver"`
+	DSN    string `config:"dsn"`
+	// Query returns the format, key and expiration time of every credential
+	// of a device. It receives the tenant and device IDs as parameters $1
+	// and $2.
+	Query string `config:"query"`
+}
+
+const defaultSQLRegistryQuery = `SELECT format, public_key, expiration_time
+FROM device_credentials
+WHERE tenant_id = $1 AND device_id = $2`
+
+// sqlRegistry reads device credentials from a SQL database. NULL expiration
+// times mean that the credential never expires.
+type sqlRegistry struct {
+	db    *sql.DB
+	query string
+}
+
+func newSQLRegistry(config *configuration) (DeviceRegistry, error) {
+	c := config.Registry.SQL
+	if c.Driver == "" || c.DSN == "" {
+		return nil, errors.New("deviceRegistry.sql.driver and deviceRegistry.sql.dsn must be set for the SQL registry")
+	}
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device registry database: %w", err)
+	}
+	return &sqlRegistry{db: db, query: c.Query}, nil
+}
+
+func (r *sqlRegistry) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	query := r.query
+	if query == "" {
+		query = defaultSQLRegistryQuery
+	}
+	rows, err := r.db.QueryContext(ctx, query, tenantID, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device credentials: %w", err)
+	}
+	defer rows.Close()
+	var creds []*deviceCredential
+	for rows.Next() {
+		var (
+			key     publicKeyCredential
+			expires sql.NullString
+		)
+		if err := rows.Scan(&key.Format, &key.Key, &expires); err != nil {
+			return nil, fmt.Errorf("failed to read device credentials: %w", err)
+		}
+		cred := &deviceCredential{
+			ExpirationTime: nonExpiringTime,
+			PublicKey:      &key,
+		}
+		if expires.Valid && expires.String != "" {
+			cred.ExpirationTime = expires.String
+		}
+		creds = append(creds, cred)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device credentials: %w", err)
+	}
+	if len(creds) == 0 {
+		return nil, unknownDeviceError{tenantID, deviceID}
+	}
+	return creds, nil
+}
+
+type httpRegistryConfig struct {
+	// URL is the base URL of the fleet registry service.
+	URL string `config:"url"`
+	// Token is sent as a bearer token with every request if it is set.
+	Token string `config:"token"`
+}
+
+// httpRegistry fetches device credentials from a fleet registry service with
+// GET <url>/tenants/<tenant>/devices/<device>/credentials. The response body
+// must be a JSON object with the credentials under "credentials".
+type httpRegistry struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newHTTPRegistry(config *configuration) (DeviceRegistry, error) {
+	if config.Registry.HTTP.URL == "" {
+		return nil, errors.New("deviceRegistry.http.url must be set for the HTTP registry")
+	}
+	return &httpRegistry{
+		baseURL: strings.TrimSuffix(config.Registry.HTTP.URL, "/"),
+		token:   config.Registry.HTTP.Token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (r *httpRegistry) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(
+		"%s/tenants/%s/devices/%s/credentials",
+		r.baseURL,
+		url.PathEscape(tenantID),
+		url.PathEscape(deviceID),
+	), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query device registry: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, unknownDeviceError{tenantID, deviceID}
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("device registry returned status %d: %s", resp.StatusCode, body)
+	}
+	var body struct {
+		Credentials []*deviceCredential `json:"credentials"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode device registry response: %w", err)
+	}
+	return body.Credentials, nil
+}
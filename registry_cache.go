@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
+)
+
+type registryCacheConfig struct {
+	// TTL is how long credentials are cached. Caching is disabled if it is
+	// zero.
+	TTL time.Duration `config:"ttl"`
+	// NegativeTTL is how long unknown devices are cached.
+	NegativeTTL time.Duration `config:"negativeTTL"`
+}
+
+// credentialCacheSweepSize is the number of cache entries after which expired
+// entries are removed whenever a new entry is added.
+const credentialCacheSweepSize = 1024
+
+type credentialCacheEntry struct {
+	creds   []*deviceCredential
+	err     error
+	expires time.Time
+}
+
+// cachedRegistry caches the results of another registry. Unknown devices are
+// cached for a shorter time than known ones and other errors are not cached at
+// all. Concurrent lookups of the same device are combined into one.
+type cachedRegistry struct {
+	registry    DeviceRegistry
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	group   singleflight.Group
+	mu      sync.Mutex
+	entries map[deviceKey]*credentialCacheEntry
+	// generation is incremented by every purge. Lookups started in an
+	// earlier generation are not cached because they may have read the
+	// purged credentials.
+	generation uint64
+}
+
+func newCachedRegistry(registry DeviceRegistry, config registryCacheConfig) *cachedRegistry {
+	return &cachedRegistry{
+		registry:    registry,
+		ttl:         config.TTL,
+		negativeTTL: config.NegativeTTL,
+		entries:     map[deviceKey]*credentialCacheEntry{},
+	}
+}
+
+func (r *cachedRegistry) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	key := deviceKey{tenantID, deviceID}
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	if ok && !timeNow().Before(entry.expires) {
+		delete(r.entries, key)
+		ok = false
+	}
+	r.mu.Unlock()
+	if ok {
+		return entry.creds, entry.err
+	}
+	result, err, _ := r.group.Do(tenantID+"\x00"+deviceID, func() (interface{}, error) {
+		r.mu.Lock()
+		generation := r.generation
+		r.mu.Unlock()
+		creds, err := r.registry.GetDeviceCredentials(ctx, tenantID, deviceID)
+		var ttl time.Duration
+		if err == nil {
+			ttl = r.ttl
+		} else if errors.As(err, &unknownDeviceError{}) {
+			ttl = r.negativeTTL
+		}
+		if ttl > 0 {
+			now := timeNow()
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if generation != r.generation {
+				return creds, err
+			}
+			if len(r.entries) >= credentialCacheSweepSize {
+				for k, e := range r.entries {
+					if !now.Before(e.expires) {
+						delete(r.entries, k)
+					}
+				}
+			}
+			r.entries[key] = &credentialCacheEntry{
+				creds:   creds,
+				err:     err,
+				expires: now.Add(ttl),
+			}
+		}
+		return creds, err
+	})
+	creds, _ := result.([]*deviceCredential)
+	return creds, err
+}
+
+// Purge removes a device from the cache so that its credentials are fetched
+// again on the next lookup.
+func (r *cachedRegistry) Purge(tenantID, deviceID string) {
+	r.mu.Lock()
+	delete(r.entries, deviceKey{tenantID, deviceID})
+	r.generation++
+	r.mu.Unlock()
+	r.group.Forget(tenantID + "\x00" + deviceID)
+}
+
+func (r *cachedRegistry) Status() jsonObj {
+	status := jsonObj{}
+	if reporter, ok := r.registry.(registryStatusReporter); ok {
+		status = reporter.Status()
+	}
+	r.mu.Lock()
+	status["cachedDevices"] = len(r.entries)
+	r.mu.Unlock()
+	return status
+}
+
+func purgeCredentialCacheHandler(cache *cachedRegistry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		cache.Purge(vars["tenant"], vars["device"])
+		logInfof("purged cached credentials of device '%s/%s'", vars["tenant"], vars["device"])
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
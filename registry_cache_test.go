@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type countingRegistry struct {
+	DeviceRegistry
+	calls   int32
+	release chan struct{}
+}
+
+func (r *countingRegistry) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	atomic.AddInt32(&r.calls, 1)
+	if r.release != nil {
+		<-r.release
+	}
+	return r.DeviceRegistry.GetDeviceCredentials(ctx, tenantID, deviceID)
+}
+
+func TestCachedRegistry(t *testing.T) {
+	now := timeNow()
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	timeNow = func() time.Time { return now }
+	bg := context.Background()
+
+	inner := &countingRegistry{DeviceRegistry: testGCP()}
+	cache := newCachedRegistry(inner, registryCacheConfig{
+		TTL:         time.Minute,
+		NegativeTTL: 10 * time.Second,
+	})
+
+	t.Run("positive", func(t *testing.T) {
+		atomic.StoreInt32(&inner.calls, 0)
+		for i := 0; i < 3; i++ {
+			creds, err := cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+			require.Nil(t, err)
+			require.Len(t, creds, 1)
+		}
+		require.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+		now = now.Add(time.Minute)
+		_, err := cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+	t.Run("negative", func(t *testing.T) {
+		atomic.StoreInt32(&inner.calls, 0)
+		for i := 0; i < 3; i++ {
+			_, err := cache.GetDeviceCredentials(bg, "test-tenant", "nonexistent")
+			require.ErrorIs(t, err, unknownDeviceError{"test-tenant", "nonexistent"})
+		}
+		require.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+		now = now.Add(10 * time.Second)
+		_, err := cache.GetDeviceCredentials(bg, "test-tenant", "nonexistent")
+		require.Error(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+	t.Run("purge", func(t *testing.T) {
+		atomic.StoreInt32(&inner.calls, 0)
+		_, err := cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&inner.calls))
+
+		r := mux.NewRouter()
+		r.Use(authorizeOperators(&operatorAuth{AdminToken: "secret"}))
+		r.Path("/admin/credential-cache/{tenant}/{device}").Methods("DELETE").
+			Name("purgeCredentialCache").Handler(purgeCredentialCacheHandler(cache))
+		purge := func(token string) int {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("DELETE", "/admin/credential-cache/test-tenant/existing", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			r.ServeHTTP(rw, req)
+			return rw.Code
+		}
+		require.Equal(t, http.StatusUnauthorized, purge(""))
+		require.Equal(t, http.StatusForbidden, purge("wrong"))
+		_, err = cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&inner.calls))
+
+		require.Equal(t, http.StatusNoContent, purge("secret"))
+		_, err = cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+	})
+	t.Run("purge during lookup", func(t *testing.T) {
+		atomic.StoreInt32(&inner.calls, 0)
+		cache.Purge("test-tenant", "existing")
+		inner.release = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+			require.Nil(t, err)
+		}()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&inner.calls) == 1
+		}, time.Second, time.Millisecond)
+		cache.Purge("test-tenant", "existing")
+		close(inner.release)
+		<-done
+		inner.release = nil
+
+		// The result of the lookup started before the purge is not cached.
+		_, err := cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+		_, err = cache.GetDeviceCredentials(bg, "test-tenant", "existing")
+		require.Nil(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(&inner.calls))
+	})
+	t.Run("concurrent lookups", func(t *testing.T) {
+		atomic.StoreInt32(&inner.calls, 0)
+		inner.release = make(chan struct{})
+		defer func() { inner.release = nil }()
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := cache.GetDeviceCredentials(bg, "test-tenant", "another existing")
+				require.Nil(t, err)
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&inner.calls) == 1
+		}, time.Second, time.Millisecond)
+		// Give the remaining goroutines time to join the pending lookup.
+		time.Sleep(50 * time.Millisecond)
+		close(inner.release)
+		wg.Wait()
+		require.Equal(t, int32(1), atomic.LoadInt32(&inner.calls))
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// fileRegistryData is the format of the device registry file. It can be
+// written in either YAML or JSON.
+type fileRegistryData struct {
+	Tenants map[string]struct {
+		Devices map[string]struct {
+			Credentials []*deviceCredential `json:"credentials" yaml:"credentials"`
+		} `json:"devices" yaml:"devices"`
+	} `json:"tenants" yaml:"tenants"`
+}
+
+// fileRegistryReloadDelay is how long the registry waits for changes to the
+// file to settle before reloading it.
+const fileRegistryReloadDelay = 100 * time.Millisecond
+
+// fileRegistry reads device credentials from a local YAML or JSON file. The
+// file is reloaded whenever it changes and malformed credentials are skipped.
+type fileRegistry struct {
+	filename string
+	watcher  *fsnotify.Watcher
+
+	mu       sync.RWMutex
+	devices  map[deviceKey][]*deviceCredential
+	hash     [sha256.Size]byte
+	loadedAt time.Time
+}
+
+func newFileRegistry(config *configuration) (DeviceRegistry, error) {
+	if config.Registry.File == "" {
+		return nil, errors.New("deviceRegistry.file must be set for the file registry")
+	}
+	r, err := loadFileRegistry(config.Registry.File)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Watch(); err != nil {
+		return nil, fmt.Errorf("failed to watch device registry: %w", err)
+	}
+	return r, nil
+}
+
+func loadFileRegistry(filename string) (*fileRegistry, error) {
+	r := &fileRegistry{filename: filename}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkCredential returns an error if the credential could never be used to
+// validate a token.
+func checkCredential(cred *deviceCredential) error {
+	if cred == nil {
+		return errors.New("credential is empty")
+	}
+	if _, err := time.Parse(time.RFC3339, cred.ExpirationTime); err != nil {
+		return errors.New("expiry time is invalid: " + cred.ExpirationTime)
+	}
+	if _, _, err := parsePublicKey(cred.PublicKey); err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return nil
+}
+
+// Reload reads the registry file if its content has changed since it was
+// last loaded and reports whether it did so. The previously loaded
+// credentials are kept if the file cannot be read or parsed.
+func (r *fileRegistry) Reload() (bool, error) {
+	data, err := os.ReadFile(r.filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to read device registry: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	r.mu.RLock()
+	unchanged := hash == r.hash && r.devices != nil
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	var raw fileRegistryData
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return false, fmt.Errorf("failed to parse device registry %s: %w", r.filename, err)
+	}
+	devices := map[deviceKey][]*deviceCredential{}
+	for tenantID, tenant := range raw.Tenants {
+		for deviceID, device := range tenant.Devices {
+			if err := checkDeviceIDs(tenantID, deviceID); err != nil {
+				logWarnf("device registry %s: skipping device: %s", r.filename, err.Error())
+				continue
+			}
+			creds := make([]*deviceCredential, 0, len(device.Credentials))
+			for i, cred := range device.Credentials {
+				if cred != nil && cred.ExpirationTime == "" {
+					cred.ExpirationTime = nonExpiringTime
+				}
+				if err := checkCredential(cred); err != nil {
+					logWarnf(
+						"device registry %s: skipping credential number %d of device '%s/%s': %s",
+						r.filename, i, tenantID, deviceID, err.Error(),
+					)
+					continue
+				}
+				creds = append(creds, cred)
+			}
+			if len(creds) == 0 {
+				logWarnf(
+					"device registry %s: skipping device '%s/%s' because it has no valid credentials",
+					r.filename, tenantID, deviceID,
+				)
+				continue
+			}
+			devices[deviceKey{tenantID, deviceID}] = creds
+		}
+	}
+	r.mu.Lock()
+	r.devices = devices
+	r.hash = hash
+	r.loadedAt = timeNow()
+	r.mu.Unlock()
+	logInfof("loaded %d devices from device registry %s", len(devices), r.filename)
+	return true, nil
+}
+
+// Watch starts reloading the registry whenever the file changes. The
+// directory containing the file is watched instead of the file itself so that
+// the file can be replaced by renaming another file over it as is done by
+// many editors and Kubernetes config maps.
+func (r *fileRegistry) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(r.filename)); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+	go func() {
+		var timer *time.Timer
+		reload := func() {
+			if _, err := r.Reload(); err != nil {
+				logErrorln("failed to reload device registry:", err)
+			}
+		}
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if timer == nil {
+					timer = time.AfterFunc(fileRegistryReloadDelay, reload)
+				} else {
+					timer.Reset(fileRegistryReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logErrorln("device registry watcher:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the registry file.
+func (r *fileRegistry) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
+
+func (r *fileRegistry) DeviceCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.devices)
+}
+
+func (r *fileRegistry) Status() jsonObj {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return jsonObj{
+		"type":     "file",
+		"file":     r.filename,
+		"devices":  len(r.devices),
+		"loadedAt": r.loadedAt,
+	}
+}
+
+func (r *fileRegistry) GetDeviceCredentials(
+	ctx context.Context,
+	tenantID string,
+	deviceID string,
+) ([]*deviceCredential, error) {
+	r.mu.RLock()
+	creds, ok := r.devices[deviceKey{tenantID, deviceID}]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, unknownDeviceError{tenantID, deviceID}
+	}
+	return creds, nil
+}
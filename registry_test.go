@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func testRegistryKey() string {
+	return testGCP().credentials["test-tenant/existing"][0].PublicKey.Key
+}
+
+func TestFileRegistry(t *testing.T) {
+	gcp := testGCP()
+	data := fileRegistryData{}
+	require.Nil(t, yaml.Unmarshal([]byte(`
+tenants:
+  test-tenant:
+    devices:
+      existing:
+        credentials:
+          - expirationTime: "1970-01-01T00:00:00Z"
+            publicKey:
+              format: RSA_X509_PEM
+              key: ""
+`), &data))
+	data.Tenants["test-tenant"].Devices["existing"].Credentials[0].PublicKey.Key = testRegistryKey()
+	yamlData, err := yaml.Marshal(&data)
+	require.Nil(t, err)
+	jsonData, err := json.Marshal(&data)
+	require.Nil(t, err)
+
+	for name, content := range map[string][]byte{
+		"registry.yaml": yamlData,
+		"registry.json": jsonData,
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), name)
+			require.Nil(t, os.WriteFile(filename, content, 0o600))
+			registry, err := loadFileRegistry(filename)
+			require.Nil(t, err)
+
+			claims, err := validateJWT(
+				context.Background(), registry, "test-tenant",
+				gcp.newTestToken("existing", "", "bag.db3", nil),
+			)
+			require.Nil(t, err)
+			require.Equal(t, "existing", claims.DeviceID)
+
+			_, err = registry.GetDeviceCredentials(context.Background(), "test-tenant", "nonexistent")
+			require.ErrorIs(t, err, unknownDeviceError{"test-tenant", "nonexistent"})
+		})
+	}
+	t.Run("aliasing IDs", func(t *testing.T) {
+		device := jsonObj{"credentials": []jsonObj{{
+			"publicKey": jsonObj{"format": "RSA_X509_PEM", "key": testRegistryKey()},
+		}}}
+		content, err := yaml.Marshal(jsonObj{"tenants": jsonObj{
+			"t1":    jsonObj{"devices": jsonObj{"../t2/d2": device, "./d": device, "x/../d": device, ".": device}},
+			"t1/..": jsonObj{"devices": jsonObj{"d": device}},
+			".":     jsonObj{"devices": jsonObj{"d": device}},
+		}})
+		require.Nil(t, err)
+		filename := filepath.Join(t.TempDir(), "registry.yaml")
+		require.Nil(t, os.WriteFile(filename, content, 0o600))
+		registry, err := loadFileRegistry(filename)
+		require.Nil(t, err)
+		require.Equal(t, 0, registry.DeviceCount())
+
+		_, err = validateJWT(
+			context.Background(), gcp, "test-tenant",
+			gcp.newTestToken("../existing", "", "bag.db3", nil),
+		)
+		require.Contains(t, err.Error(), "invalid tenant or device ID")
+		for _, ids := range [][2]string{{".", "d"}, {"t", "."}, {"..", "d"}, {"t", ""}} {
+			require.Error(t, checkDeviceIDs(ids[0], ids[1]), "%v", ids)
+		}
+		require.Nil(t, checkDeviceIDs("t.1", "d.1"))
+	})
+	t.Run("missing file", func(t *testing.T) {
+		_, err := loadFileRegistry(filepath.Join(t.TempDir(), "missing.yaml"))
+		require.Error(t, err)
+	})
+}
+
+func TestFileRegistryReload(t *testing.T) {
+	writeRegistry := func(t *testing.T, filename string, devices map[string]string) {
+		t.Helper()
+		tenant := map[string]interface{}{}
+		for device, key := range devices {
+			tenant[device] = jsonObj{"credentials": []jsonObj{{
+				"publicKey": jsonObj{"format": "RSA_X509_PEM", "key": key},
+			}}}
+		}
+		data, err := yaml.Marshal(jsonObj{"tenants": jsonObj{"test-tenant": jsonObj{"devices": tenant}}})
+		require.Nil(t, err)
+		// Replace the file atomically the same way as many editors do.
+		tmp := filename + ".tmp"
+		require.Nil(t, os.WriteFile(tmp, data, 0o600))
+		require.Nil(t, os.Rename(tmp, filename))
+	}
+	bg := context.Background()
+	filename := filepath.Join(t.TempDir(), "registry.yaml")
+	writeRegistry(t, filename, map[string]string{
+		"existing":    testRegistryKey(),
+		"invalid-key": "not a key",
+	})
+	registry, err := newFileRegistry(&configuration{Registry: registryConfig{File: filename}})
+	require.Nil(t, err)
+	defer registry.(*fileRegistry).Close()
+
+	// Devices with malformed credentials are skipped.
+	require.Equal(t, 1, registry.(*fileRegistry).DeviceCount())
+	creds, err := registry.GetDeviceCredentials(bg, "test-tenant", "existing")
+	require.Nil(t, err)
+	require.Equal(t, nonExpiringTime, creds[0].ExpirationTime)
+	_, err = registry.GetDeviceCredentials(bg, "test-tenant", "invalid-key")
+	require.ErrorIs(t, err, unknownDeviceError{"test-tenant", "invalid-key"})
+
+	writeRegistry(t, filename, map[string]string{
+		"existing": testRegistryKey(),
+		"added":    testRegistryKey(),
+	})
+	require.Eventually(t, func() bool {
+		_, err := registry.GetDeviceCredentials(bg, "test-tenant", "added")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The old credentials are kept if the file cannot be parsed.
+	require.Nil(t, os.WriteFile(filename, []byte("tenants: ["), 0o600))
+	reloaded, err := registry.(*fileRegistry).Reload()
+	require.Error(t, err)
+	require.False(t, reloaded)
+	require.Equal(t, 2, registry.(*fileRegistry).DeviceCount())
+
+	rw := httptest.NewRecorder()
+	registryStatusHandler(registry.(registryStatusReporter)).ServeHTTP(
+		rw, httptest.NewRequest("GET", "/diagnostics/device-registry", nil),
+	)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var status struct {
+		Type    string `json:"type"`
+		File    string `json:"file"`
+		Devices int    `json:"devices"`
+	}
+	require.Nil(t, json.NewDecoder(rw.Body).Decode(&status))
+	require.Equal(t, "file", status.Type)
+	require.Equal(t, filename, status.File)
+	require.Equal(t, 2, status.Devices)
+
+	t.Run("authorization", func(t *testing.T) {
+		r := mux.NewRouter()
+		r.Use(authorizeOperators(&operatorAuth{}))
+		r.Path("/diagnostics/device-registry").Name("registryStatus").
+			Handler(registryStatusHandler(registry.(registryStatusReporter)))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest("GET", "/diagnostics/device-registry", nil))
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+	})
+}
+
+func TestSQLRegistry(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "registry.db"))
+	require.Nil(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE device_credentials (
+		tenant_id TEXT, device_id TEXT, format TEXT, public_key TEXT, expiration_time TEXT
+	)`)
+	require.Nil(t, err)
+	_, err = db.Exec(
+		`INSERT INTO device_credentials VALUES ($1, $2, $3, $4, NULL), ($1, $2, $3, $4, $5)`,
+		"test-tenant", "existing", "RSA_X509_PEM", testRegistryKey(), "2021-03-27T00:00:00Z",
+	)
+	require.Nil(t, err)
+
+	registry := &sqlRegistry{db: db}
+	creds, err := registry.GetDeviceCredentials(context.Background(), "test-tenant", "existing")
+	require.Nil(t, err)
+	require.Len(t, creds, 2)
+	require.Equal(t, nonExpiringTime, creds[0].ExpirationTime)
+	require.Equal(t, "2021-03-27T00:00:00Z", creds[1].ExpirationTime)
+	require.Equal(t, "RSA_X509_PEM", creds[1].PublicKey.Format)
+
+	claims, err := validateJWT(
+		context.Background(), registry, "test-tenant",
+		testGCP().newTestToken("existing", "", "bag.db3", nil),
+	)
+	require.Nil(t, err)
+	require.Equal(t, "existing", claims.DeviceID)
+
+	_, err = registry.GetDeviceCredentials(context.Background(), "test-tenant", "nonexistent")
+	require.ErrorIs(t, err, unknownDeviceError{"test-tenant", "nonexistent"})
+}
+
+func TestHTTPRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/api/tenants/test-tenant/devices/another%20existing/credentials" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(rw, jsonObj{"credentials": []jsonObj{{
+			"expirationTime": nonExpiringTime,
+			"publicKey": jsonObj{
+				"format": "RSA_X509_PEM",
+				"key":    testRegistryKey(),
+			},
+		}}})
+	}))
+	defer server.Close()
+	bg := context.Background()
+
+	registry := &httpRegistry{baseURL: server.URL + "/api", token: "secret", client: server.Client()}
+	creds, err := registry.GetDeviceCredentials(bg, "test-tenant", "another existing")
+	require.Nil(t, err)
+	require.Len(t, creds, 1)
+	require.Equal(t, "RSA_X509_PEM", creds[0].PublicKey.Format)
+	require.True(t, strings.HasPrefix(creds[0].PublicKey.Key, "-----BEGIN CERTIFICATE-----"))
+
+	_, err = registry.GetDeviceCredentials(bg, "test-tenant", "nonexistent")
+	require.ErrorIs(t, err, unknownDeviceError{"test-tenant", "nonexistent"})
+
+	registry.token = "wrong"
+	_, err = registry.GetDeviceCredentials(bg, "test-tenant", "another existing")
+	require.Error(t, err)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errTokenReplayed is returned when a token ID has already been used.
+var errTokenReplayed = errors.New("token has already been used")
+
+// nonceStorePruneInterval is how often expired IDs are removed from a
+// nonceStore.
+const nonceStorePruneInterval = time.Minute
+
+type nonceRecord struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// nonceStore remembers used token IDs until the tokens expire. If it is
+// backed by a file, every ID is appended to the file so that tokens cannot be
+// replayed after a restart. The file is compacted when expired IDs are pruned.
+type nonceStore struct {
+	mu         sync.Mutex
+	seen       map[string]time.Time
+	lastPruned time.Time
+	filename   string
+	file       *os.File
+}
+
+func newNonceStore() *nonceStore {
+	return &nonceStore{seen: map[string]time.Time{}, lastPruned: timeNow()}
+}
+
+// openNonceStore returns a nonceStore backed by the given file. IDs which have
+// not expired yet are loaded from the file if it exists.
+func openNonceStore(filename string) (*nonceStore, error) {
+	s := newNonceStore()
+	s.filename = filename
+	f, err := os.Open(filename) //#nosec G304
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open token ID store: %w", err)
+	}
+	if err == nil {
+		defer f.Close()
+		now := timeNow()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec nonceRecord
+			// A partially written last line is ignored.
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			if now.Before(rec.Expires) {
+				s.seen[rec.ID] = rec.Expires
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read token ID store: %w", err)
+		}
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Use records that id has been used by a token which expires at expires. An
+// error is returned if it has already been used.
+func (s *nonceStore) Use(id string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := timeNow()
+	if now.Sub(s.lastPruned) >= nonceStorePruneInterval {
+		s.prune(now)
+	}
+	if prev, ok := s.seen[id]; ok && now.Before(prev) {
+		return errTokenReplayed
+	}
+	s.seen[id] = expires
+	if s.file != nil {
+		line, err := json.Marshal(nonceRecord{ID: id, Expires: expires})
+		if err != nil {
+			return err
+		}
+		if _, err := s.file.Write(append(line, '\n')); err != nil {
+			logErrorln("failed to write token ID store:", err)
+		}
+	}
+	return nil
+}
+
+// prune removes expired IDs. s.mu must be held.
+func (s *nonceStore) prune(now time.Time) {
+	s.lastPruned = now
+	removed := 0
+	for id, expires := range s.seen {
+		if !now.Before(expires) {
+			delete(s.seen, id)
+			removed++
+		}
+	}
+	if removed > 0 && s.file != nil {
+		if err := s.compact(); err != nil {
+			logErrorln(err)
+		}
+	}
+}
+
+// compact replaces the backing file with one containing only the IDs which
+// are currently remembered. s.mu must be held unless s is not shared yet.
+func (s *nonceStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact token ID store: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for id, expires := range s.seen {
+		if err = enc.Encode(nonceRecord{ID: id, Expires: expires}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact token ID store: %w", err)
+	}
+	f, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open token ID store: %w", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = f
+	return nil
+}
+
+// Close closes the backing file.
+func (s *nonceStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonceStore(t *testing.T) {
+	now := timeNow()
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	timeNow = func() time.Time { return now }
+	filename := filepath.Join(t.TempDir(), "jti.log")
+
+	store, err := openNonceStore(filename)
+	require.Nil(t, err)
+	require.Nil(t, store.Use("a", now.Add(time.Hour)))
+	require.Nil(t, store.Use("b", now.Add(time.Second)))
+	require.ErrorIs(t, store.Use("a", now.Add(time.Hour)), errTokenReplayed)
+	require.Nil(t, store.Close())
+
+	// Used IDs are remembered after a restart.
+	store, err = openNonceStore(filename)
+	require.Nil(t, err)
+	require.ErrorIs(t, store.Use("a", now.Add(time.Hour)), errTokenReplayed)
+	require.ErrorIs(t, store.Use("b", now.Add(time.Second)), errTokenReplayed)
+
+	// Expired IDs are forgotten and removed from the file.
+	now = now.Add(nonceStorePruneInterval)
+	require.Nil(t, store.Use("b", now.Add(time.Second)))
+	require.Nil(t, store.Use("c", now.Add(time.Second)))
+	require.Nil(t, store.Close())
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	t.Run("truncated file", func(t *testing.T) {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+		require.Nil(t, err)
+		_, err = f.WriteString(`{"id":"d","exp`)
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		store, err := openNonceStore(filename)
+		require.Nil(t, err)
+		defer store.Close()
+		require.ErrorIs(t, store.Use("c", now.Add(time.Second)), errTokenReplayed)
+		require.Nil(t, store.Use("d", now.Add(time.Second)))
+	})
+}
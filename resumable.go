@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumableUploader is implemented by storage backends which support
+// resumable uploads. Sessions follow the protocol used by GCS resumable
+// uploads: the device uploads chunks to the session URL with PUT requests
+// containing a Content-Range header and queries the number of committed bytes
+// by sending an empty PUT request with the header "Content-Range: bytes */*".
+// Incomplete sessions are answered with status 308 and a Range header
+// containing the committed bytes.
+//
+// See https://cloud.google.com/storage/docs/performing-resumable-uploads.
+type resumableUploader interface {
+	// ResumableUploadURL starts a new upload session and returns its URL.
+	ResumableUploadURL(ctx context.Context, tenantID, deviceID, name string, c uploadConstraints) (*signedURL, error)
+}
+
+func resumableURLHandler(backend StorageBackend, policy *uploadPolicy, catalog *bagCatalog) deviceHandler {
+	return func(rw http.ResponseWriter, r *http.Request, claims *jwtClaims) {
+		uploader, ok := tenantStorage(backend, claims.TenantID).(resumableUploader)
+		if !ok {
+			writeErrMsg(rw, http.StatusNotImplemented, "resumable uploads are not supported")
+			return
+		}
+		name, constraints, ok := uploadTarget(rw, r, backend, policy, claims)
+		if !ok {
+			return
+		}
+		sessionURL, err := uploader.ResumableUploadURL(
+			r.Context(),
+			claims.TenantID,
+			claims.DeviceID,
+			name,
+			constraints,
+		)
+		if err == nil {
+			err = recordIssuedURL(r, catalog, claims, name, sessionURL)
+		}
+		if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		writeJSON(rw, sessionURL)
+	}
+}
+
+// ResumableUploadURL initiates a resumable upload session using a signed URL.
+// Only the content type and the overwrite precondition can be bound to the
+// session.
+func (b *gcsBackend) ResumableUploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	headers := map[string]string{"x-goog-resumable": "start"}
+	if c.ContentType != "" {
+		headers["Content-Type"] = c.ContentType
+	}
+	if c.NoOverwrite {
+		headers["x-goog-if-generation-match"] = "0"
+	}
+	startURL, err := b.gen.generate(tenantID, deviceID, name, "POST", headers)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", startURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	client := b.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start resumable upload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf(
+			"failed to start resumable upload: unexpected status %d: %s",
+			resp.StatusCode, body,
+		)
+	}
+	sessionURL := resp.Header.Get("Location")
+	if sessionURL == "" {
+		return nil, errors.New("failed to start resumable upload: session URL is missing")
+	}
+	return &signedURL{URL: sessionURL, Expires: timeNow().Add(gcsSessionValidDuration)}, nil
+}
+
+// gcsSessionValidDuration is how long GCS resumable upload sessions can be
+// used.
+const gcsSessionValidDuration = 7 * 24 * time.Hour
+
+const (
+	// partialFilePrefix is prepended to the names of files containing
+	// incomplete uploads in local mode.
+	partialFilePrefix = ".partial-"
+	// completedFilePrefix is prepended to the session ID in the names of the
+	// files marking completed resumable upload sessions in local mode.
+	completedFilePrefix = ".completed-"
+)
+
+// localSessionValidDuration is how long resumable upload sessions can be used
+// in local mode.
+const localSessionValidDuration = 7 * 24 * time.Hour
+
+// keyedMutex is a set of mutexes identified by keys. Mutexes are removed when
+// nobody holds or waits for them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// Lock locks the mutex of the key and returns a function which unlocks it.
+func (m *keyedMutex) Lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyedLock{}
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.users++
+	m.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// sessionLocks serializes the requests of resumable upload sessions in local
+// mode. The keys are the paths of the partial files.
+var sessionLocks keyedMutex
+
+var sessionIDRegexp = regexp.MustCompile("^[0-9a-f]{32}$")
+
+func newRandomID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+func (b *localBackend) ResumableUploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	session, err := newRandomID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	// The name must stay the same during the whole session.
+	if name == "" {
+		name = generateBagName()
+	}
+	// The session URL is valid as long as GCS resumable upload sessions.
+	query := uploadQuery(tenantID, deviceID, name, c)
+	query.Set("session", session)
+	return &signedURL{
+		URL:     b.signURL("PUT", "/upload", query, localSessionValidDuration),
+		Expires: timeNow().Add(localSessionValidDuration),
+	}, nil
+}
+
+func (b *localBackend) partialFilePath(tenantID, deviceID, session string) string {
+	return filepath.Join(b.deviceDir(tenantID, deviceID), partialFilePrefix+session)
+}
+
+func (b *localBackend) completedFilePath(tenantID, deviceID, session string) string {
+	return filepath.Join(b.deviceDir(tenantID, deviceID), completedFilePrefix+session)
+}
+
+// removeExpiredSessions removes the partial files of abandoned uploads and the
+// markers of completed sessions which have not been modified for
+// localSessionValidDuration. The URLs of such sessions have expired.
+func (b *localBackend) removeExpiredSessions() error {
+	cutoff := timeNow().Add(-localSessionValidDuration)
+	return filepath.WalkDir(b.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || !(strings.HasPrefix(name, partialFilePrefix) || strings.HasPrefix(name, completedFilePrefix)) {
+			return nil
+		}
+		// Both files of a session are guarded by the lock of the partial
+		// file, which receiveResumableUpload holds while appending to it.
+		session := strings.TrimPrefix(name, partialFilePrefix)
+		if session == name {
+			session = strings.TrimPrefix(name, completedFilePrefix)
+		}
+		unlock := sessionLocks.Lock(filepath.Join(filepath.Dir(p), partialFilePrefix+session))
+		defer unlock()
+		info, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cleanupSessions calls removeExpiredSessions every interval.
+func (b *localBackend) cleanupSessions(interval time.Duration) {
+	for {
+		if err := b.removeExpiredSessions(); err != nil {
+			logErrorln("failed to remove expired upload sessions:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// contentRange is a parsed Content-Range header. First is -1 if the request
+// contains no data and Total is -1 if the total size is unknown.
+type contentRange struct {
+	First, Last, Total int64
+}
+
+var errInvalidContentRange = errors.New("invalid Content-Range header")
+
+func parseContentRange(header string) (contentRange, error) {
+	cr := contentRange{First: -1, Last: -1, Total: -1}
+	spec := strings.TrimPrefix(header, "bytes ")
+	if spec == header {
+		return cr, errInvalidContentRange
+	}
+	i := strings.IndexByte(spec, '/')
+	if i < 0 {
+		return cr, errInvalidContentRange
+	}
+	rangeSpec, totalSpec := spec[:i], spec[i+1:]
+	var err error
+	if totalSpec != "*" {
+		if cr.Total, err = strconv.ParseInt(totalSpec, 10, 64); err != nil || cr.Total < 0 {
+			return cr, errInvalidContentRange
+		}
+	}
+	if rangeSpec == "*" {
+		return cr, nil
+	}
+	i = strings.IndexByte(rangeSpec, '-')
+	if i < 0 {
+		return cr, errInvalidContentRange
+	}
+	if cr.First, err = strconv.ParseInt(rangeSpec[:i], 10, 64); err != nil || cr.First < 0 {
+		return cr, errInvalidContentRange
+	}
+	if cr.Last, err = strconv.ParseInt(rangeSpec[i+1:], 10, 64); err != nil || cr.Last < cr.First {
+		return cr, errInvalidContentRange
+	}
+	if cr.Total >= 0 && cr.Last >= cr.Total {
+		return cr, errInvalidContentRange
+	}
+	return cr, nil
+}
+
+// writeResumeIncomplete tells the device that the upload session is still
+// incomplete and how many bytes have been committed so far.
+func writeResumeIncomplete(rw http.ResponseWriter, committed int64) {
+	if committed > 0 {
+		rw.Header().Set("Range", fmt.Sprintf("bytes=0-%d", committed-1))
+	}
+	rw.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// receiveResumableUpload handles a single request of a resumable upload
+// session in local mode. Data is appended to a partial file which is moved
+// into place when the last byte has been received.
+func receiveResumableUpload(
+	rw http.ResponseWriter,
+	r *http.Request,
+	backend *localBackend,
+	catalog *bagCatalog,
+	tenant, device, bagName, session string,
+	expected []uploadConstraints,
+	noOverwrite bool,
+) {
+	if !sessionIDRegexp.MatchString(session) {
+		writeErrMsg(rw, http.StatusBadRequest, "invalid session")
+		return
+	}
+	cr := contentRange{First: 0, Last: -1, Total: -1}
+	if header := r.Header.Get("Content-Range"); header != "" {
+		var err error
+		if cr, err = parseContentRange(header); err != nil {
+			writeErrMsg(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	maxSize := expected[0].MaxSize
+	if maxSize > 0 && cr.Total > maxSize {
+		writeSizeErr(rw, errUploadTooLarge)
+		return
+	}
+	partialPath := backend.partialFilePath(tenant, device, session)
+	completedPath := backend.completedFilePath(tenant, device, session)
+	finalPath := backend.filePath(tenant, device, bagName)
+	// Retries may arrive while an earlier request of the session is still
+	// writing to the partial file.
+	defer sessionLocks.Lock(partialPath)()
+	f, err := os.OpenFile(partialPath, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(completedPath); err == nil {
+			// The session has already been completed.
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		f, err = os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0o644) //#nosec G302
+	}
+	if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	defer f.Close()
+	committed, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if cr.First > committed {
+		// The device has lost track of the committed bytes.
+		writeResumeIncomplete(rw, committed)
+		return
+	}
+	if cr.First >= 0 {
+		err := checkFreeSpace(filepath.Dir(partialPath), r.ContentLength, backend.DiskReserve)
+		if writeSizeErr(rw, err) {
+			return
+		} else if err != nil {
+			logErrorln(err)
+			internalServerErr(rw)
+			return
+		}
+		if maxSize > 0 {
+			limit := maxSize - cr.First
+			if limit < 0 {
+				limit = 0
+			}
+			limitRequestBody(rw, r, limit)
+		}
+		// Skip data which has already been committed.
+		if _, err := io.CopyN(io.Discard, r.Body, committed-cr.First); err != nil {
+			writeResumeIncomplete(rw, committed)
+			return
+		}
+		start := committed
+		n, err := io.Copy(f, r.Body)
+		committed += n
+		if errors.Is(err, errUploadTooLarge) {
+			// The session can never be completed so it is discarded.
+			if err := os.Remove(partialPath); err != nil {
+				logErrorln(err)
+			}
+		}
+		if writeSizeErr(rw, err) {
+			return
+		} else if err != nil {
+			logErrorln("resumable upload interrupted:", err)
+			writeResumeIncomplete(rw, committed)
+			return
+		}
+		if cr.Last >= 0 && committed != cr.Last+1 {
+			// The data does not match the range so it is not committed.
+			if err := f.Truncate(start); err != nil {
+				logErrorln(err)
+				internalServerErr(rw)
+				return
+			}
+			writeErrMsg(rw, http.StatusBadRequest, "request body does not match Content-Range")
+			return
+		}
+	}
+	complete := committed == cr.Total ||
+		(cr.Total < 0 && r.Header.Get("Content-Range") == "")
+	if !complete {
+		writeResumeIncomplete(rw, committed)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if err := f.Close(); err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	digests, err := digestFile(partialPath)
+	if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if err := digests.verify(expected...); err != nil {
+		// The data cannot be fixed by resuming so the session is discarded.
+		logErrorln(err)
+		if err := os.Remove(partialPath); err != nil {
+			logErrorln(err)
+		}
+		writeErrMsg(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	// The session is marked as completed before the bag is moved into place
+	// so that a retry of the last request is never taken for a new session.
+	if err := os.WriteFile(completedPath, nil, 0o644); err != nil { //#nosec G306
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if noOverwrite {
+		err = renameNoReplace(partialPath, finalPath)
+	} else {
+		err = os.Rename(partialPath, finalPath)
+	}
+	if err != nil {
+		if err := os.Remove(completedPath); err != nil {
+			logErrorln(err)
+		}
+	}
+	if errors.Is(err, errObjectExists) {
+		if err := os.Remove(partialPath); err != nil {
+			logErrorln(err)
+		}
+		writeErrMsg(rw, http.StatusConflict, "bag already exists")
+		return
+	} else if err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if err := writeDigests(finalPath, digests); err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if err := catalog.RecordCompleted(r.Context(), tenant, device, bagName, digests); err != nil {
+		logErrorln(err)
+		internalServerErr(rw)
+		return
+	}
+	if err := syncDir(filepath.Dir(finalPath)); err != nil {
+		logErrorln(err)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
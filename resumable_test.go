@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContentRange(t *testing.T) {
+	testCases := []struct {
+		header string
+		want   contentRange
+		valid  bool
+	}{
+		{"bytes 0-99/100", contentRange{0, 99, 100}, true},
+		{"bytes 100-199/*", contentRange{100, 199, -1}, true},
+		{"bytes */100", contentRange{-1, -1, 100}, true},
+		{"bytes */*", contentRange{-1, -1, -1}, true},
+		{"bytes 0-100/100", contentRange{}, false},
+		{"bytes 10-9/100", contentRange{}, false},
+		{"bytes 0-9", contentRange{}, false},
+		{"0-9/10", contentRange{}, false},
+		{"bytes a-9/10", contentRange{}, false},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.header, func(t *testing.T) {
+			cr, err := parseContentRange(tC.header)
+			if tC.valid {
+				require.Nil(t, err)
+				require.Equal(t, tC.want, cr)
+			} else {
+				require.ErrorIs(t, err, errInvalidContentRange)
+			}
+		})
+	}
+}
+
+func TestLocalResumableUploading(t *testing.T) {
+	gcp := testGCP()
+	dir := t.TempDir()
+
+	r := mux.NewRouter()
+	server := httptest.NewServer(r)
+	defer server.Close()
+	backend := &localBackend{
+		Dir:             dir,
+		Host:            server.URL,
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	r.Path("/generate-resumable-url").Methods("POST").Handler(
+		authenticateDevice(readTokenWithoutValidation, resumableURLHandler(backend, &uploadPolicy{}, nil)),
+	)
+	r.Path("/upload").Methods("PUT").Handler(receiveUploadHandler(backend, nil))
+
+	startSession := func(t *testing.T, bagName string) string {
+		t.Helper()
+		req, err := http.NewRequestWithContext(
+			context.Background(), "POST", server.URL+"/generate-resumable-url", nil,
+		)
+		require.Nil(t, err)
+		req.Header.Add("Authorization", "Bearer "+gcp.newTestToken("testdevice", "test-tenant", bagName, nil))
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var url struct{ URL string }
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(&url))
+		require.Contains(t, url.URL, "&session=")
+		return url.URL
+	}
+
+	put := func(t *testing.T, sessionURL, contentRange, data string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(
+			context.Background(), "PUT", sessionURL, strings.NewReader(data),
+		)
+		require.Nil(t, err)
+		if contentRange != "" {
+			req.Header.Set("Content-Range", contentRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("resume after interruption", func(t *testing.T) {
+		sessionURL := startSession(t, "resumed.db3")
+
+		resp := put(t, sessionURL, "bytes */11", "")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "", resp.Header.Get("Range"))
+
+		resp = put(t, sessionURL, "bytes 0-4/*", "hello")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "bytes=0-4", resp.Header.Get("Range"))
+
+		resp = put(t, sessionURL, "bytes */11", "")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "bytes=0-4", resp.Header.Get("Range"))
+
+		_, err := os.Stat(filepath.Join(dir, "test-tenant", "testdevice", "resumed.db3"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		objects, err := backend.List(context.Background(), "test-tenant", "testdevice")
+		require.Nil(t, err)
+		require.Empty(t, objects)
+
+		// Overlapping data is skipped.
+		resp = put(t, sessionURL, "bytes 3-10/11", "lo world")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		data, err := os.ReadFile(filepath.Join(dir, "test-tenant", "testdevice", "resumed.db3"))
+		require.Nil(t, err)
+		require.Equal(t, "hello world", string(data))
+
+		resp = put(t, sessionURL, "bytes */11", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+	t.Run("new session for existing bag", func(t *testing.T) {
+		first := startSession(t, "replaced.db3")
+		require.Equal(t, http.StatusOK, put(t, first, "", "first").StatusCode)
+		second := startSession(t, "replaced.db3")
+		require.Equal(t, http.StatusOK, put(t, second, "", "second").StatusCode)
+		data, err := os.ReadFile(filepath.Join(dir, "test-tenant", "testdevice", "replaced.db3"))
+		require.Nil(t, err)
+		require.Equal(t, "second", string(data))
+		// Retries of completed sessions do not change the bag.
+		require.Equal(t, http.StatusOK, put(t, first, "", "first").StatusCode)
+		data, err = os.ReadFile(filepath.Join(dir, "test-tenant", "testdevice", "replaced.db3"))
+		require.Nil(t, err)
+		require.Equal(t, "second", string(data))
+	})
+	t.Run("gap in data", func(t *testing.T) {
+		sessionURL := startSession(t, "gap.db3")
+		resp := put(t, sessionURL, "bytes 0-4/10", "hello")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		resp = put(t, sessionURL, "bytes 6-9/10", "orld")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "bytes=0-4", resp.Header.Get("Range"))
+	})
+	t.Run("body not matching range", func(t *testing.T) {
+		sessionURL := startSession(t, "mismatch-range.db3")
+		resp := put(t, sessionURL, "bytes 0-9/20", "hello")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = put(t, sessionURL, "bytes 0-1/20", "hello")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		// Nothing has been committed.
+		resp = put(t, sessionURL, "bytes */20", "")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		require.Equal(t, "", resp.Header.Get("Range"))
+	})
+	t.Run("single request", func(t *testing.T) {
+		sessionURL := startSession(t, "")
+		resp := put(t, sessionURL, "", "whole file")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		data, err := os.ReadFile(filepath.Join(dir, "test-tenant", "testdevice", generateBagName()))
+		require.Nil(t, err)
+		require.Equal(t, "whole file", string(data))
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		u, err := backend.ResumableUploadURL(
+			context.Background(), "test-tenant", "testdevice", "mismatch.db3",
+			uploadConstraints{ContentSHA256: helloWorldSHA256},
+		)
+		require.Nil(t, err)
+		resp := put(t, u.URL, "bytes 0-4/*", "hello")
+		require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+		resp = put(t, u.URL, "bytes 5-10/11", " there")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		_, err = os.Stat(filepath.Join(dir, "test-tenant", "testdevice", "mismatch.db3"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		parsed, err := url.Parse(u.URL)
+		require.Nil(t, err)
+		session := parsed.Query().Get("session")
+		_, err = os.Stat(backend.partialFilePath("test-tenant", "testdevice", session))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("invalid session", func(t *testing.T) {
+		resp := put(t, backend.signURL("PUT", "/upload", url.Values{
+			"device":  {"testdevice"},
+			"bagName": {"x.db3"},
+			"session": {"../x"},
+		}, time.Minute), "", "data")
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestRemoveExpiredSessions(t *testing.T) {
+	backend := &localBackend{Dir: t.TempDir()}
+	deviceDir := backend.deviceDir("tenant", "device")
+	require.Nil(t, os.MkdirAll(deviceDir, 0o755))
+	old := timeNow().Add(-localSessionValidDuration - time.Minute)
+	files := map[string]bool{
+		partialFilePrefix + "abandoned":   false,
+		completedFilePrefix + "abandoned": false,
+		partialFilePrefix + "active":      true,
+		"old.db3":                         true,
+	}
+	for name := range files {
+		path := filepath.Join(deviceDir, name)
+		require.Nil(t, os.WriteFile(path, nil, 0o600))
+		if name != partialFilePrefix+"active" {
+			require.Nil(t, os.Chtimes(path, old, old))
+		}
+	}
+	require.Nil(t, backend.removeExpiredSessions())
+	for name, kept := range files {
+		_, err := os.Stat(filepath.Join(deviceDir, name))
+		require.Equal(t, kept, err == nil, name)
+	}
+}
+
+// blockingReader signals started when it is first read and then blocks until
+// data can be read from the pipe.
+type blockingReader struct {
+	*io.PipeReader
+	started chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	return r.PipeReader.Read(p)
+}
+
+func TestRemoveExpiredSessionsDuringUpload(t *testing.T) {
+	backend := &localBackend{Dir: t.TempDir(), SigningKey: []byte("secret")}
+	session := strings.Repeat("a", 32)
+	partialPath := backend.partialFilePath("tenant", "device", session)
+	require.Nil(t, os.MkdirAll(filepath.Dir(partialPath), 0o755))
+	require.Nil(t, os.WriteFile(partialPath, []byte("hello"), 0o600))
+	old := timeNow().Add(-localSessionValidDuration - time.Minute)
+	require.Nil(t, os.Chtimes(partialPath, old, old))
+
+	pr, pw := io.Pipe()
+	body := &blockingReader{PipeReader: pr, started: make(chan struct{})}
+	u, err := url.Parse(backend.signURL("PUT", "/upload", url.Values{
+		"tenant":  {"tenant"},
+		"device":  {"device"},
+		"bagName": {"appended.db3"},
+		"session": {session},
+	}, time.Minute))
+	require.Nil(t, err)
+	req := httptest.NewRequest("PUT", u.RequestURI(), body)
+	req.Header.Set("Content-Range", "bytes 5-10/*")
+	uploaded := make(chan int)
+	go func() {
+		resp := httptest.NewRecorder()
+		receiveUploadHandler(backend, nil).ServeHTTP(resp, req)
+		uploaded <- resp.Code
+	}()
+	<-body.started
+
+	// The cleanup waits for the append, after which the session is active.
+	cleaned := make(chan error)
+	go func() { cleaned <- backend.removeExpiredSessions() }()
+	select {
+	case err := <-cleaned:
+		t.Fatalf("cleanup did not wait for the upload: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = pw.Write([]byte(" world"))
+	require.Nil(t, err)
+	require.Nil(t, pw.Close())
+	require.Equal(t, http.StatusPermanentRedirect, <-uploaded)
+	require.Nil(t, <-cleaned)
+	data, err := os.ReadFile(partialPath)
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(data))
+}
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+	unlockA := m.Lock("a")
+	locked := make(chan struct{})
+	go func() {
+		defer m.Lock("a")()
+		close(locked)
+	}()
+	// Other keys are not blocked.
+	m.Lock("b")()
+	select {
+	case <-locked:
+		t.Fatal("mutex was locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlockA()
+	<-locked
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.locks) == 0
+	}, time.Second, time.Millisecond)
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGCSResumableUploadURL(t *testing.T) {
+	gcp := testGCP()
+	var startReq *http.Request
+	backend := &gcsBackend{
+		gen: &urlGenerator{
+			Bucket:        "testbucket",
+			Account:       "testaccount",
+			SigningKey:    gcp.rawPrivateKey,
+			ValidDuration: 5 * time.Minute,
+			Scheme:        "v4",
+		},
+		httpClient: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			startReq = r
+			return &http.Response{
+				StatusCode: http.StatusCreated,
+				Header: http.Header{
+					"Location": {"https://storage.googleapis.com/upload/session?upload_id=abc"},
+				},
+				Body: io.NopCloser(strings.NewReader("")),
+			}, nil
+		})},
+	}
+	url, err := backend.ResumableUploadURL(
+		context.Background(), "test-tenant", "existing", "bag.db3",
+		uploadConstraints{ContentType: "application/octet-stream"},
+	)
+	require.Nil(t, err)
+	require.Equal(t, "https://storage.googleapis.com/upload/session?upload_id=abc", url.URL)
+	require.Equal(t, "POST", startReq.Method)
+	require.Equal(t, "storage.googleapis.com", startReq.URL.Host)
+	require.Equal(t, "/testbucket/test-tenant/existing/bag.db3", startReq.URL.Path)
+	require.Equal(t, "start", startReq.Header.Get("x-goog-resumable"))
+	require.Equal(t, "application/octet-stream", startReq.Header.Get("Content-Type"))
+	require.Equal(t,
+		"content-type;host;x-goog-resumable",
+		startReq.URL.Query().Get("X-Goog-SignedHeaders"),
+	)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/md5" //#nosec G501
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+type s3Config struct {
+	Endpoint        string `config:"endpoint"`
+	Region          string `config:"region"`
+	AccessKeyID     string `config:"accessKeyId"`
+	SecretAccessKey string `config:"secretAccessKey"`
+}
+
+// s3Backend stores bags in an S3 compatible object storage such as MinIO.
+// Objects are addressed using path-style URLs.
+type s3Backend struct {
+	Endpoint      *url.URL
+	Bucket        string
+	Prefix        string
+	ValidDuration time.Duration
+	Signer        *sigV4Signer
+	Client        *http.Client
+}
+
+func newS3Backend(config *configuration) (StorageBackend, error) {
+	endpoint, err := url.Parse(config.S3.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("invalid S3 endpoint: scheme and host are required")
+	}
+	region := config.S3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Backend{
+		Endpoint:      endpoint,
+		Bucket:        config.Bucket,
+		Prefix:        objectPrefix(config.DataObjectPrefix),
+		ValidDuration: config.URLValidDuration,
+		Signer: &sigV4Signer{
+			AccessKeyID:     config.S3.AccessKeyID,
+			SecretAccessKey: config.S3.SecretAccessKey,
+			Region:          region,
+			Service:         "s3",
+		},
+		Client: http.DefaultClient,
+	}, nil
+}
+
+func (b *s3Backend) objectURL(key string) *url.URL {
+	u := *b.Endpoint
+	u.Path = path.Join("/", u.Path, b.Bucket, key)
+	u.RawPath = ""
+	u.RawQuery = ""
+	return &u
+}
+
+func (b *s3Backend) presign(method, tenantID, deviceID, name string, headers map[string]string) string {
+	if name == "" {
+		name = generateBagName()
+	}
+	u := b.objectURL(objectName(b.Prefix, tenantID, deviceID, name))
+	return b.Signer.Presign(method, u, headers, timeNow(), b.ValidDuration).String()
+}
+
+// UploadURL binds the content type and checksums into the signature. S3 does
+// not support limiting the size of uploads done with presigned PUT requests
+// so MaxSize is ignored.
+func (b *s3Backend) UploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	headers := map[string]string{}
+	if c.ContentType != "" {
+		headers["Content-Type"] = c.ContentType
+	}
+	if c.ContentMD5 != "" {
+		headers["Content-MD5"] = c.ContentMD5
+	}
+	if c.ContentCRC32C != "" {
+		headers["x-amz-checksum-crc32c"] = c.ContentCRC32C
+	}
+	if c.ContentSHA256 != "" {
+		headers["x-amz-checksum-sha256"] = c.ContentSHA256
+	}
+	if c.NoOverwrite {
+		headers["If-None-Match"] = "*"
+	}
+	u := &signedURL{
+		URL:     b.presign("PUT", tenantID, deviceID, name, headers),
+		Expires: timeNow().Add(b.ValidDuration),
+	}
+	if len(headers) > 0 {
+		u.Headers = headers
+	}
+	return u, nil
+}
+
+func (b *s3Backend) DownloadURL(ctx context.Context, tenantID, deviceID, name string) (string, error) {
+	return b.presign("GET", tenantID, deviceID, name, nil), nil
+}
+
+func (b *s3Backend) do(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	b.Signer.SignRequest(req, emptyPayloadSHA256, timeNow())
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	} else if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 request %s %s failed with status %d: %s", method, u.Path, resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func (b *s3Backend) Stat(ctx context.Context, tenantID, deviceID, name string) (*objectInfo, error) {
+	resp, err := b.do(ctx, "HEAD", b.objectURL(objectName(b.Prefix, tenantID, deviceID, name)))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	updated, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &objectInfo{
+		Name:    name,
+		Size:    resp.ContentLength,
+		Updated: updated,
+		MD5:     etagMD5(resp.Header.Get("ETag")),
+	}, nil
+}
+
+// etagMD5 returns the base64 encoded MD5 hash contained in the ETag of an
+// object. The ETag of objects uploaded in multiple parts is not a hash of the
+// content, in which case an empty string is returned.
+func etagMD5(etag string) string {
+	sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(sum) != md5.Size {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *s3Backend) List(ctx context.Context, tenantID, deviceID string) ([]*objectInfo, error) {
+	var objects []*objectInfo
+	u := b.objectURL("")
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {objectName(b.Prefix, tenantID, deviceID, "") + "/"},
+	}
+	for {
+		u.RawQuery = query.Encode()
+		resp, err := b.do(ctx, "GET", u)
+		if errors.Is(err, errObjectNotFound) {
+			return nil, fmt.Errorf("bucket %s does not exist", b.Bucket)
+		} else if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode S3 object listing: %w", err)
+		}
+		for _, obj := range result.Contents {
+			objects = append(objects, &objectInfo{
+				Name:    path.Base(obj.Key),
+				Size:    obj.Size,
+				Updated: obj.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (b *s3Backend) Delete(ctx context.Context, tenantID, deviceID, name string) error {
+	// S3 reports success when deleting nonexistent objects so existence has
+	// to be checked separately.
+	if _, err := b.Stat(ctx, tenantID, deviceID, name); err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, "DELETE", b.objectURL(objectName(b.Prefix, tenantID, deviceID, name)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm     = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat    = "20060102T150405Z"
+	sigV4DateFormat    = "20060102"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sigV4Signer signs requests using AWS Signature Version 4 as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html.
+type sigV4Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	Service         string
+}
+
+// awsURIEncode encodes s as required by SigV4. Slashes are left as is unless
+// encodeSlash is true.
+func awsURIEncode(s string, encodeSlash bool) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalHeaders returns the canonical header block and the semicolon
+// separated list of signed header names for headers.
+func canonicalHeaders(headers map[string]string) (canonical, signed string) {
+	names := make([]string, 0, len(headers))
+	values := make(map[string]string, len(headers))
+	for k, v := range headers {
+		k = strings.ToLower(k)
+		names = append(names, k)
+		values[k] = strings.Join(strings.Fields(v), " ")
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k + ":" + values[k] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sigV4Signer) scope(now time.Time) string {
+	return strings.Join([]string{
+		now.Format(sigV4DateFormat), s.Region, s.Service, "aws4_request",
+	}, "/")
+}
+
+func (s *sigV4Signer) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		s.scope(now),
+		sha256Hex(canonicalRequest),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Presign returns a copy of u with query parameters that authorize a single
+// request with the given method until expires has elapsed from now. The host
+// header and headers are signed and the latter must be sent with the request
+// as is.
+func (s *sigV4Signer) Presign(
+	method string,
+	u *url.URL,
+	headers map[string]string,
+	now time.Time,
+	expires time.Duration,
+) *url.URL {
+	now = now.UTC()
+	signedHeaders := map[string]string{"host": u.Host}
+	for k, v := range headers {
+		signedHeaders[k] = v
+	}
+	headerBlock, headerNames := canonicalHeaders(signedHeaders)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", headerNames)
+	canonicalURI := awsURIEncode(u.Path, false)
+	canonicalQuery := canonicalQueryString(query)
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQuery,
+		headerBlock,
+		headerNames,
+		unsignedPayload,
+	}, "\n")
+	signed := *u
+	signed.RawPath = canonicalURI
+	signed.RawQuery = canonicalQuery + "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return &signed
+}
+
+// SignRequest adds an Authorization header to req. payloadHash is the hex
+// encoded SHA-256 hash of the request body.
+func (s *sigV4Signer) SignRequest(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headerBlock, signedHeaders := canonicalHeaders(map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format(sigV4TimeFormat),
+	})
+	canonicalURI := awsURIEncode(req.URL.Path, false)
+	canonicalQuery := canonicalQueryString(req.URL.Query())
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery,
+		headerBlock,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.URL.RawPath = canonicalURI
+	req.URL.RawQuery = canonicalQuery
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm,
+		s.AccessKeyID,
+		s.scope(now),
+		signedHeaders,
+		s.signature(now, canonicalRequest),
+	))
+}
+
+const (
+	gcsV4Algorithm = "GOOG4-RSA-SHA256"
+	gcsHost        = "storage.googleapis.com"
+)
+
+// signGCSV4 returns a path-style URL for object in bucket signed with the GCS
+// V4 signing process described in
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually.
+// It follows the same canonicalization rules as AWS SigV4 but the string to
+// sign is signed with the service account's RSA key. This is used instead of
+// storage.SignedURL because the latter always reads the current time from the
+// system clock.
+func signGCSV4(
+	key *rsa.PrivateKey,
+	account string,
+	method string,
+	bucket string,
+	object string,
+	headers map[string]string,
+	now time.Time,
+	expires time.Duration,
+) (string, error) {
+	now = now.UTC()
+	signedHeaders := map[string]string{"host": gcsHost}
+	for k, v := range headers {
+		signedHeaders[k] = v
+	}
+	headerBlock, headerNames := canonicalHeaders(signedHeaders)
+	scope := now.Format(sigV4DateFormat) + "/auto/storage/goog4_request"
+	canonicalURI := awsURIEncode("/"+bucket+"/"+object, false)
+	canonicalQuery := canonicalQueryString(url.Values{
+		"X-Goog-Algorithm":     {gcsV4Algorithm},
+		"X-Goog-Credential":    {account + "/" + scope},
+		"X-Goog-Date":          {now.Format(sigV4TimeFormat)},
+		"X-Goog-Expires":       {strconv.FormatInt(int64(expires/time.Second), 10)},
+		"X-Goog-SignedHeaders": {headerNames},
+	})
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQuery,
+		headerBlock,
+		headerNames,
+		unsignedPayload,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		gcsV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"https://%s%s?%s&X-Goog-Signature=%s",
+		gcsHost,
+		canonicalURI,
+		canonicalQuery,
+		hex.EncodeToString(signature),
+	), nil
+}
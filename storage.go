@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5" //#nosec G501
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// StorageBackend is implemented by every storage system bags can be uploaded
+// to. Objects are addressed by tenant, device and bag name and the backend is
+// responsible for mapping them to its own naming scheme.
+type StorageBackend interface {
+	// UploadURL returns a URL the device can upload the bag to with a PUT
+	// request. If name is empty the backend chooses a name. Backends enforce
+	// as many of the constraints as they are able to.
+	UploadURL(ctx context.Context, tenantID, deviceID, name string, c uploadConstraints) (*signedURL, error)
+	// DownloadURL returns a URL the bag can be downloaded from with a GET
+	// request.
+	DownloadURL(ctx context.Context, tenantID, deviceID, name string) (string, error)
+	// Stat returns information about a single bag. errObjectNotFound is
+	// returned if the bag does not exist.
+	Stat(ctx context.Context, tenantID, deviceID, name string) (*objectInfo, error)
+	// List returns all bags uploaded by a device sorted by name.
+	List(ctx context.Context, tenantID, deviceID string) ([]*objectInfo, error)
+	// Delete removes a bag. errObjectNotFound is returned if the bag does not
+	// exist.
+	Delete(ctx context.Context, tenantID, deviceID, name string) error
+}
+
+// uploadConstraints restrict what may be uploaded with an upload URL. Zero
+// values leave the property unrestricted.
+type uploadConstraints struct {
+	ContentType string
+	// ContentMD5 is the base64 encoded MD5 hash of the content.
+	ContentMD5 string
+	// ContentCRC32C is the base64 encoded big-endian CRC32C checksum of the
+	// content.
+	ContentCRC32C string
+	// ContentSHA256 is the base64 encoded SHA-256 hash of the content.
+	ContentSHA256 string
+	// MaxSize is the maximum size of the content in bytes.
+	MaxSize int64
+	// NoOverwrite makes the storage reject the upload if the object already
+	// exists.
+	NoOverwrite bool
+}
+
+func (c *uploadConstraints) validate() error {
+	if c.ContentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(c.ContentMD5)
+		if err != nil || len(sum) != md5.Size {
+			return errors.New("invalid MD5 hash: " + c.ContentMD5)
+		}
+	}
+	if c.ContentCRC32C != "" {
+		sum, err := base64.StdEncoding.DecodeString(c.ContentCRC32C)
+		if err != nil || len(sum) != crc32.Size {
+			return errors.New("invalid CRC32C checksum: " + c.ContentCRC32C)
+		}
+	}
+	if c.ContentSHA256 != "" {
+		sum, err := base64.StdEncoding.DecodeString(c.ContentSHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return errors.New("invalid SHA-256 hash: " + c.ContentSHA256)
+		}
+	}
+	if c.MaxSize < 0 {
+		return errors.New("invalid maximum size: " + strconv.FormatInt(c.MaxSize, 10))
+	}
+	return nil
+}
+
+// signedURL is returned to the device together with the headers it has to
+// send with the request for the signature to be valid.
+type signedURL struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// UploadID identifies the upload in the catalog. It is empty if the
+	// catalog is disabled.
+	UploadID string `json:"uploadId,omitempty"`
+	// Expires is when the URL stops being valid. It is recorded in the
+	// catalog.
+	Expires time.Time `json:"-"`
+}
+
+type objectInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Updated time.Time `json:"updated"`
+	// The base64 encoded checksums of the content are empty if the storage
+	// does not report them.
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// digests returns the checksums of the object.
+func (o *objectInfo) digests() *uploadDigests {
+	return &uploadDigests{
+		Size:   o.Size,
+		SHA256: o.SHA256,
+		MD5:    o.MD5,
+		CRC32C: o.CRC32C,
+	}
+}
+
+var errObjectNotFound = errors.New("object not found")
+
+type storageBackendFactory func(config *configuration) (StorageBackend, error)
+
+// storageBackends contains all available storage backends by the name used to
+// select them in the configuration.
+var storageBackends = map[string]storageBackendFactory{
+	"gcs":   newGCSBackend,
+	"local": newLocalBackend,
+	"s3":    newS3Backend,
+}
+
+func storageBackendFromConfig(config *configuration) (StorageBackend, error) {
+	newBackend, ok := storageBackends[config.storageBackendName()]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend: %s", config.StorageBackend)
+	}
+	// Local backends of all tenants must share the signing key because only
+	// one of them receives the uploads.
+	if config.LocalSigningKey == "" && config.usesStorageBackend("local") {
+		if err := generateLocalSigningKey(config); err != nil {
+			return nil, err
+		}
+	}
+	backend, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return newTenantBackend(config, backend)
+}
+
+type gcsBackend struct {
+	gen    *urlGenerator
+	client *storage.Client
+	// httpClient is used for requests made with signed URLs. If it is nil,
+	// http.DefaultClient is used.
+	httpClient *http.Client
+}
+
+func newGCSBackend(config *configuration) (StorageBackend, error) {
+	gen := urlGeneratorFromConfig(config)
+	switch gen.Scheme {
+	case "", "v2":
+	case "v4":
+		if gen.ValidDuration > maxV4ValidDuration {
+			return nil, fmt.Errorf("urlValidDuration must not exceed %v with V4 signing", maxV4ValidDuration)
+		}
+	default:
+		return nil, fmt.Errorf("unknown URL signing scheme: %s", gen.Scheme)
+	}
+	client, err := storage.NewClient(
+		context.Background(),
+		option.WithCredentialsJSON(config.jsonCredentials),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	return &gcsBackend{
+		gen:    gen,
+		client: client,
+	}, nil
+}
+
+func (b *gcsBackend) UploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	return b.gen.GenerateUpload(tenantID, deviceID, name, c)
+}
+
+func (b *gcsBackend) DownloadURL(ctx context.Context, tenantID, deviceID, name string) (string, error) {
+	return b.gen.Generate(tenantID, deviceID, name, "GET")
+}
+
+func gcsObjectInfo(attrs *storage.ObjectAttrs) *objectInfo {
+	info := &objectInfo{
+		Name:    path.Base(attrs.Name),
+		Size:    attrs.Size,
+		Updated: attrs.Updated,
+		// The SHA-256 hash is stored in the metadata by the device and is not
+		// verified by GCS.
+		SHA256: attrs.Metadata["sha256"],
+	}
+	if len(attrs.MD5) > 0 {
+		info.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	var crc [crc32.Size]byte
+	binary.BigEndian.PutUint32(crc[:], attrs.CRC32C)
+	info.CRC32C = base64.StdEncoding.EncodeToString(crc[:])
+	return info
+}
+
+func (b *gcsBackend) Stat(ctx context.Context, tenantID, deviceID, name string) (*objectInfo, error) {
+	attrs, err := b.client.Bucket(b.gen.Bucket).
+		Object(b.gen.ObjectName(tenantID, deviceID, name)).
+		Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, errObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return gcsObjectInfo(attrs), nil
+}
+
+func (b *gcsBackend) List(ctx context.Context, tenantID, deviceID string) ([]*objectInfo, error) {
+	it := b.client.Bucket(b.gen.Bucket).Objects(ctx, &storage.Query{
+		Prefix: b.gen.ObjectName(tenantID, deviceID, "") + "/",
+	})
+	var objects []*objectInfo
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		objects = append(objects, gcsObjectInfo(attrs))
+	}
+	return objects, nil
+}
+
+func (b *gcsBackend) Delete(ctx context.Context, tenantID, deviceID, name string) error {
+	err := b.client.Bucket(b.gen.Bucket).
+		Object(b.gen.ObjectName(tenantID, deviceID, name)).
+		Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// localBackend stores bags in a directory on the local filesystem. Files are
+// uploaded through receiveUploadHandler.
+type localBackend struct {
+	Dir             string
+	Host            string
+	DefaultTenantID string
+	// SigningKey is the HMAC key used to sign the URLs served by the backend.
+	SigningKey    []byte
+	ValidDuration time.Duration
+	// DiskReserve is the amount of free disk space in bytes uploads may not
+	// use.
+	DiskReserve int64
+}
+
+func newLocalBackend(config *configuration) (StorageBackend, error) {
+	if config.LocalDir == "" {
+		return nil, errors.New("fileStorageDirectory must be set for local storage")
+	}
+	if config.URLValidDuration <= 0 {
+		return nil, errors.New("urlValidDuration must be set for local storage")
+	}
+	if config.LocalSigningKey == "" {
+		if err := generateLocalSigningKey(config); err != nil {
+			return nil, err
+		}
+	}
+	return &localBackend{
+		Dir:             config.LocalDir,
+		Host:            config.Host,
+		DefaultTenantID: config.DefaultTenantID,
+		SigningKey:      []byte(config.LocalSigningKey),
+		ValidDuration:   config.URLValidDuration,
+		DiskReserve:     config.Uploads.DiskReserve,
+	}, nil
+}
+
+// generateLocalSigningKey sets fileStorageSigningKey to a random key.
+func generateLocalSigningKey(config *configuration) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate URL signing key: %w", err)
+	}
+	config.LocalSigningKey = string(key)
+	logWarnf("fileStorageSigningKey is not set, URLs issued before a restart will not be accepted after it")
+	return nil
+}
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errURLExpired       = errors.New("URL has expired")
+)
+
+// signature computes the signature of a URL served by the backend. It covers
+// the method, the resource and every query parameter except the signature.
+// The resource is the path of the handler and is used instead of the request
+// path so that the backend can be served behind a path prefix.
+func (b *localBackend) signature(method, resource string, query url.Values) string {
+	params := url.Values{}
+	for k, v := range query {
+		if k != "signature" {
+			params[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, b.SigningKey)
+	// Encode sorts the parameters by key.
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, resource, params.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns a URL of the resource which is valid for validFor.
+func (b *localBackend) signURL(method, resource string, query url.Values, validFor time.Duration) string {
+	query.Set("expires", strconv.FormatInt(timeNow().Add(validFor).Unix(), 10))
+	query.Set("signature", b.signature(method, resource, query))
+	return b.Host + resource + "?" + query.Encode()
+}
+
+// verifyURL checks that the request was made to an unexpired URL returned by
+// signURL.
+func (b *localBackend) verifyURL(r *http.Request, resource string) error {
+	query := r.URL.Query()
+	expected := b.signature(r.Method, resource, query)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected)) {
+		return errInvalidSignature
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if !timeNow().Before(time.Unix(expires, 0)) {
+		return errURLExpired
+	}
+	return nil
+}
+
+func (b *localBackend) deviceDir(tenantID, deviceID string) string {
+	if tenantID == "" {
+		tenantID = b.DefaultTenantID
+	}
+	return filepath.Join(
+		b.Dir,
+		pathSegmentSanitizer.Replace(tenantID),
+		pathSegmentSanitizer.Replace(deviceID),
+	)
+}
+
+func (b *localBackend) filePath(tenantID, deviceID, name string) string {
+	return filepath.Join(
+		b.deviceDir(tenantID, deviceID),
+		pathSegmentSanitizer.Replace(name),
+	)
+}
+
+// errIncompleteUpload is returned when the uploaded data ends before the size
+// given by the client has been received.
+var errIncompleteUpload = errors.New("upload is incomplete")
+
+// writeFileAtomically stores the content of r as filePath. The data is written
+// to a temporary file in the same directory which is moved into place only
+// after it has been completely received and flushed to disk, so a partially
+// written file is never visible under its final name. If size is not negative
+// exactly size bytes must be received. If verify is not nil, it is called after
+// the data has been received and the file is discarded if it returns an error.
+// If noOverwrite is true and filePath exists, errObjectExists is returned.
+func writeFileAtomically(
+	filePath string,
+	r io.Reader,
+	size int64,
+	verify func() error,
+	noOverwrite bool,
+) (err error) {
+	dir := filepath.Dir(filePath)
+	f, err := os.CreateTemp(dir, partialFilePrefix+"upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	n, err := io.Copy(f, r)
+	if errors.Is(err, errUploadTooLarge) || isDiskFull(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", errIncompleteUpload, err)
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("%w: received %d of %d bytes", errIncompleteUpload, n, size)
+	}
+	if verify != nil {
+		if err = verify(); err != nil {
+			return err
+		}
+	}
+	if err = f.Chmod(0o644); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if noOverwrite {
+		err = renameNoReplace(f.Name(), filePath)
+	} else {
+		err = os.Rename(f.Name(), filePath)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory to disk so that renames within it persist.
+func syncDir(dir string) error {
+	d, err := os.Open(dir) //#nosec G304
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (b *localBackend) UploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	return &signedURL{
+		URL:     b.signURL("PUT", "/upload", uploadQuery(tenantID, deviceID, name, c), b.ValidDuration),
+		Expires: timeNow().Add(b.ValidDuration),
+	}, nil
+}
+
+// uploadQuery returns the query parameters of a local upload URL. The
+// checksums and the maximum size are included so that they are covered by the
+// signature.
+func uploadQuery(tenantID, deviceID, name string, c uploadConstraints) url.Values {
+	q := url.Values{
+		"tenant":  {tenantID},
+		"device":  {deviceID},
+		"bagName": {name},
+	}
+	for k, v := range map[string]string{
+		"contentMD5":    c.ContentMD5,
+		"contentCRC32C": c.ContentCRC32C,
+		"contentSHA256": c.ContentSHA256,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if c.MaxSize > 0 {
+		q.Set("maxSize", strconv.FormatInt(c.MaxSize, 10))
+	}
+	if c.NoOverwrite {
+		q.Set("noOverwrite", "true")
+	}
+	return q
+}
+
+func (b *localBackend) DownloadURL(ctx context.Context, tenantID, deviceID, name string) (string, error) {
+	query := url.Values{
+		"tenant":  {tenantID},
+		"device":  {deviceID},
+		"bagName": {name},
+	}
+	return b.signURL("GET", "/download", query, b.ValidDuration), nil
+}
+
+func localObjectInfo(fi os.FileInfo) *objectInfo {
+	return &objectInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Updated: fi.ModTime(),
+	}
+}
+
+func (b *localBackend) Stat(ctx context.Context, tenantID, deviceID, name string) (*objectInfo, error) {
+	filePath := b.filePath(tenantID, deviceID, name)
+	fi, err := os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info := localObjectInfo(fi)
+	// Bags stored before digests were recorded have no digest file.
+	if d, err := readDigests(filePath); err == nil {
+		info.SHA256, info.MD5, info.CRC32C = d.SHA256, d.MD5, d.CRC32C
+	}
+	return info, nil
+}
+
+func (b *localBackend) List(ctx context.Context, tenantID, deviceID string) ([]*objectInfo, error) {
+	entries, err := os.ReadDir(b.deviceDir(tenantID, deviceID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	objects := make([]*objectInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Hidden files contain partial uploads and metadata.
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, localObjectInfo(fi))
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (b *localBackend) Delete(ctx context.Context, tenantID, deviceID, name string) error {
+	filePath := b.filePath(tenantID, deviceID, name)
+	err := os.Remove(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errObjectNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(digestFilePath(filePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalBackend(t *testing.T) {
+	backend := &localBackend{
+		Dir:             t.TempDir(),
+		Host:            "http://localhost:9000",
+		DefaultTenantID: "fleet-registry",
+		SigningKey:      []byte("secret"),
+		ValidDuration:   5 * time.Minute,
+	}
+	bg := context.Background()
+
+	writeFile := func(t *testing.T, tenant, device, name, data string) {
+		t.Helper()
+		dir := filepath.Join(backend.Dir, tenant, device)
+		require.Nil(t, os.MkdirAll(dir, 0o755))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600))
+	}
+
+	t.Run("upload URL", func(t *testing.T) {
+		url, err := backend.UploadURL(bg, "test-tenant", "dev 1", "a.db3", uploadConstraints{})
+		require.Nil(t, err)
+		require.Equal(t,
+			"http://localhost:9000/upload?bagName=a.db3&device=dev+1&expires=1616758260&signature=nB2E-nYxBg6iM5XLU-VKlWCs63UPmFyJDFDdOjcfuyo&tenant=test-tenant",
+			url.URL,
+		)
+	})
+	t.Run("verify URL", func(t *testing.T) {
+		url, err := backend.UploadURL(bg, "test-tenant", "dev 1", "a.db3", uploadConstraints{})
+		require.Nil(t, err)
+		verify := func(method, u string) error {
+			return backend.verifyURL(httptest.NewRequest(method, u, nil), "/upload")
+		}
+		require.Nil(t, verify("PUT", url.URL))
+		require.ErrorIs(t, verify("POST", url.URL), errInvalidSignature)
+		require.ErrorIs(t, verify("PUT", strings.Replace(url.URL, "a.db3", "b.db3", 1)), errInvalidSignature)
+		require.ErrorIs(t, verify("PUT", url.URL+"&session=0123"), errInvalidSignature)
+		require.ErrorIs(t, verify("PUT", "http://localhost:9000/upload?device=dev+1"), errInvalidSignature)
+
+		defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+		expired := timeNow().Add(backend.ValidDuration)
+		timeNow = func() time.Time { return expired }
+		require.ErrorIs(t, verify("PUT", url.URL), errURLExpired)
+	})
+	t.Run("atomic write", func(t *testing.T) {
+		dir := filepath.Join(backend.Dir, "test-tenant", "atomicdevice")
+		require.Nil(t, os.MkdirAll(dir, 0o755))
+		filePath := filepath.Join(dir, "a.db3")
+
+		err := writeFileAtomically(filePath, io.MultiReader(
+			strings.NewReader("hello"),
+			iotest.ErrReader(io.ErrUnexpectedEOF),
+		), -1, nil, false)
+		require.ErrorIs(t, err, errIncompleteUpload)
+		err = writeFileAtomically(filePath, strings.NewReader("hello"), 10, nil, false)
+		require.ErrorIs(t, err, errIncompleteUpload)
+		entries, err := os.ReadDir(dir)
+		require.Nil(t, err)
+		require.Empty(t, entries)
+
+		require.Nil(t, writeFileAtomically(filePath, strings.NewReader("hello"), 5, nil, false))
+		data, err := os.ReadFile(filePath)
+		require.Nil(t, err)
+		require.Equal(t, "hello", string(data))
+		entries, err = os.ReadDir(dir)
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+	})
+	t.Run("stat", func(t *testing.T) {
+		writeFile(t, "test-tenant", "statdevice", "a.db3", "hello")
+		info, err := backend.Stat(bg, "test-tenant", "statdevice", "a.db3")
+		require.Nil(t, err)
+		require.Equal(t, "a.db3", info.Name)
+		require.Equal(t, int64(5), info.Size)
+
+		_, err = backend.Stat(bg, "test-tenant", "statdevice", "missing.db3")
+		require.ErrorIs(t, err, errObjectNotFound)
+	})
+	t.Run("default tenant", func(t *testing.T) {
+		writeFile(t, "fleet-registry", "defaultdevice", "a.db3", "hello")
+		_, err := backend.Stat(bg, "", "defaultdevice", "a.db3")
+		require.Nil(t, err)
+	})
+	t.Run("list", func(t *testing.T) {
+		writeFile(t, "test-tenant", "listdevice", "b.db3", "world")
+		writeFile(t, "test-tenant", "listdevice", "a.db3", "hello")
+		objects, err := backend.List(bg, "test-tenant", "listdevice")
+		require.Nil(t, err)
+		require.Len(t, objects, 2)
+		require.Equal(t, "a.db3", objects[0].Name)
+		require.Equal(t, "b.db3", objects[1].Name)
+
+		objects, err = backend.List(bg, "test-tenant", "nonexistent")
+		require.Nil(t, err)
+		require.Empty(t, objects)
+	})
+	t.Run("delete", func(t *testing.T) {
+		writeFile(t, "test-tenant", "deletedevice", "a.db3", "hello")
+		require.Nil(t, backend.Delete(bg, "test-tenant", "deletedevice", "a.db3"))
+		require.ErrorIs(t,
+			backend.Delete(bg, "test-tenant", "deletedevice", "a.db3"),
+			errObjectNotFound,
+		)
+	})
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errUnknownTenant  = errors.New("unknown tenant")
+	errTenantDisabled = errors.New("tenant is disabled")
+)
+
+// tenantConfig overrides the global configuration for a tenant. Empty values
+// are inherited from the global configuration.
+type tenantConfig struct {
+	Enabled          bool          `json:"enabled"`
+	Bucket           string        `json:"bucket,omitempty"`
+	DataObjectPrefix string        `json:"dataObjectPrefix,omitempty"`
+	URLValidDuration time.Duration `json:"urlValidDuration,omitempty"`
+	StorageBackend   string        `json:"storageBackend,omitempty"`
+	// MaxUploadSize overrides uploads.maxSize and uploads.tenantMaxSizes if
+	// it is not nil. Zero means unlimited.
+	MaxUploadSize *int64 `json:"maxUploadSize,omitempty"`
+	// DeviceRate and DeviceBurst override rateLimits.deviceRate and
+	// rateLimits.deviceBurst if they are not nil.
+	DeviceRate  *float64 `json:"deviceRate,omitempty"`
+	DeviceBurst *int     `json:"deviceBurst,omitempty"`
+}
+
+// overridesStorage reports whether the tenant needs a storage backend of its
+// own.
+func (t *tenantConfig) overridesStorage() bool {
+	return t.Bucket != "" || t.DataObjectPrefix != "" || t.URLValidDuration != 0 || t.StorageBackend != ""
+}
+
+// parseDuration parses a duration string or a number of nanoseconds.
+func parseDuration(value interface{}) (time.Duration, error) {
+	s := fmt.Sprint(value)
+	if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ns), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseTenantConfig(value interface{}) (*tenantConfig, error) {
+	t := &tenantConfig{Enabled: true}
+	if value == nil {
+		return t, nil
+	}
+	options, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid options: %v", value)
+	}
+	for key, v := range options {
+		var err error
+		// Keys read from the configuration file are lowercased.
+		switch strings.ToLower(key) {
+		case "enabled":
+			t.Enabled, err = strconv.ParseBool(fmt.Sprint(v))
+		case "bucket":
+			t.Bucket = fmt.Sprint(v)
+		case "dataobjectprefix":
+			t.DataObjectPrefix = fmt.Sprint(v)
+		case "urlvalidduration":
+			t.URLValidDuration, err = parseDuration(v)
+		case "storagebackend":
+			t.StorageBackend = fmt.Sprint(v)
+		case "maxuploadsize":
+			var size int64
+			size, err = strconv.ParseInt(fmt.Sprint(v), 10, 64)
+			t.MaxUploadSize = &size
+		case "devicerate":
+			var rate float64
+			rate, err = strconv.ParseFloat(fmt.Sprint(v), 64)
+			t.DeviceRate = &rate
+		case "deviceburst":
+			var burst int
+			burst, err = strconv.Atoi(fmt.Sprint(v))
+			t.DeviceBurst = &burst
+		default:
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, v)
+		}
+	}
+	return t, nil
+}
+
+// tenantKey returns the key of a tenant in the maps of the configuration.
+// Keys read from the configuration file are lowercased so tenant IDs are
+// compared case-insensitively.
+func tenantKey(tenantID string) string {
+	return strings.ToLower(tenantID)
+}
+
+// tenantConfigs contains the tenants allowed to use the service by tenant key.
+// Every tenant is allowed if it is empty. It can be given as a map in the
+// configuration file or as a JSON object in flags and environment variables.
+type tenantConfigs map[string]*tenantConfig
+
+func (c *tenantConfigs) String() string {
+	if len(*c) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(*c)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (c *tenantConfigs) Set(value string) error {
+	parsed, err := c.Parse(value)
+	if err != nil {
+		return err
+	}
+	*c = parsed.(tenantConfigs)
+	return nil
+}
+
+func (c *tenantConfigs) Type() string {
+	return "tenants"
+}
+
+// Parse implements configloader.Option.
+func (c *tenantConfigs) Parse(value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok {
+		if strings.TrimSpace(s) == "" {
+			return tenantConfigs{}, nil
+		}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("tenants must be given as a JSON object: %w", err)
+		}
+		value = obj
+	}
+	tenants := tenantConfigs{}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for tenantID, v := range value {
+			t, err := parseTenantConfig(v)
+			if err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", tenantID, err)
+			}
+			key := tenantKey(tenantID)
+			if _, ok := tenants[key]; ok {
+				return nil, fmt.Errorf("duplicate tenant %s", tenantID)
+			}
+			tenants[key] = t
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("invalid tenants: %v", value)
+	}
+	return tenants, nil
+}
+
+func (c tenantConfigs) validate() error {
+	for tenantID, t := range c {
+		if t.URLValidDuration < 0 {
+			return fmt.Errorf("invalid urlValidDuration for tenant %s: %v", tenantID, t.URLValidDuration)
+		}
+		if t.MaxUploadSize != nil && *t.MaxUploadSize < 0 {
+			return fmt.Errorf("invalid maxUploadSize for tenant %s: %d", tenantID, *t.MaxUploadSize)
+		}
+		if (t.DeviceRate != nil && *t.DeviceRate < 0) || (t.DeviceBurst != nil && *t.DeviceBurst < 0) {
+			return fmt.Errorf("invalid device rate limit for tenant %s", tenantID)
+		}
+		if _, ok := storageBackends[t.StorageBackend]; t.StorageBackend != "" && !ok {
+			return fmt.Errorf("unknown storage backend for tenant %s: %s", tenantID, t.StorageBackend)
+		}
+	}
+	return nil
+}
+
+// get returns the configuration of the tenant.
+func (c tenantConfigs) get(tenantID string) (*tenantConfig, bool) {
+	t, ok := c[tenantKey(tenantID)]
+	return t, ok
+}
+
+// check returns an error if the tenant is not allowed to use the service.
+func (c tenantConfigs) check(tenantID string) error {
+	if len(c) == 0 {
+		return nil
+	}
+	t, ok := c.get(tenantID)
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownTenant, tenantID)
+	}
+	if !t.Enabled {
+		return fmt.Errorf("%w: %s", errTenantDisabled, tenantID)
+	}
+	return nil
+}
+
+// resolve returns the ID under which the tenant is configured. It is the ID
+// as given if no tenants are configured. Tokens are resolved once so that
+// storage, registry lookups, permissions and limits use the same ID.
+func (c tenantConfigs) resolve(tenantID string) string {
+	if len(c) == 0 {
+		return tenantID
+	}
+	return tenantKey(tenantID)
+}
+
+// ids returns the IDs of the tenants in sorted order.
+func (c tenantConfigs) ids() []string {
+	ids := make([]string, 0, len(c))
+	for tenantID := range c {
+		ids = append(ids, tenantID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// withTenant returns a copy of the configuration with the overrides of the
+// tenant applied.
+func (c *configuration) withTenant(t *tenantConfig) *configuration {
+	config := *c
+	if t.Bucket != "" {
+		config.Bucket = t.Bucket
+	}
+	if t.DataObjectPrefix != "" {
+		config.DataObjectPrefix = t.DataObjectPrefix
+	}
+	if t.URLValidDuration != 0 {
+		config.URLValidDuration = t.URLValidDuration
+	}
+	if t.StorageBackend != "" {
+		config.StorageBackend = t.StorageBackend
+	}
+	return &config
+}
+
+// usesStorageBackend reports whether the storage backend is used globally or
+// by any tenant.
+func (c *configuration) usesStorageBackend(name string) bool {
+	if c.storageBackendName() == name {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if c.withTenant(t).storageBackendName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantBackend routes requests to the storage backends of tenants which
+// override the storage configuration.
+type tenantBackend struct {
+	Default StorageBackend
+	// Tenants contains the backends by tenant key.
+	Tenants map[string]StorageBackend
+}
+
+func newTenantBackend(config *configuration, defaultBackend StorageBackend) (StorageBackend, error) {
+	b := &tenantBackend{Default: defaultBackend, Tenants: map[string]StorageBackend{}}
+	for _, tenantID := range config.Tenants.ids() {
+		t := config.Tenants[tenantID]
+		if !t.overridesStorage() {
+			continue
+		}
+		tenantConfig := config.withTenant(t)
+		newBackend, ok := storageBackends[tenantConfig.storageBackendName()]
+		if !ok {
+			return nil, fmt.Errorf("unknown storage backend for tenant %s: %s", tenantID, t.StorageBackend)
+		}
+		backend, err := newBackend(tenantConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+		b.Tenants[tenantKey(tenantID)] = backend
+	}
+	if len(b.Tenants) == 0 {
+		return defaultBackend, nil
+	}
+	return b, nil
+}
+
+// backend returns the storage backend of the tenant.
+func (b *tenantBackend) backend(tenantID string) StorageBackend {
+	if backend, ok := b.Tenants[tenantKey(tenantID)]; ok {
+		return backend
+	}
+	return b.Default
+}
+
+func (b *tenantBackend) UploadURL(
+	ctx context.Context,
+	tenantID, deviceID, name string,
+	c uploadConstraints,
+) (*signedURL, error) {
+	return b.backend(tenantID).UploadURL(ctx, tenantID, deviceID, name, c)
+}
+
+func (b *tenantBackend) DownloadURL(ctx context.Context, tenantID, deviceID, name string) (string, error) {
+	return b.backend(tenantID).DownloadURL(ctx, tenantID, deviceID, name)
+}
+
+func (b *tenantBackend) Stat(ctx context.Context, tenantID, deviceID, name string) (*objectInfo, error) {
+	return b.backend(tenantID).Stat(ctx, tenantID, deviceID, name)
+}
+
+func (b *tenantBackend) List(ctx context.Context, tenantID, deviceID string) ([]*objectInfo, error) {
+	return b.backend(tenantID).List(ctx, tenantID, deviceID)
+}
+
+func (b *tenantBackend) Delete(ctx context.Context, tenantID, deviceID, name string) error {
+	return b.backend(tenantID).Delete(ctx, tenantID, deviceID, name)
+}
+
+// tenantStorage returns the storage backend which stores the bags of the
+// tenant.
+func tenantStorage(backend StorageBackend, tenantID string) StorageBackend {
+	if b, ok := backend.(*tenantBackend); ok {
+		return b.backend(tenantID)
+	}
+	return backend
+}
+
+// allStorage returns every storage backend requests can be routed to.
+func allStorage(backend StorageBackend) []StorageBackend {
+	b, ok := backend.(*tenantBackend)
+	if !ok {
+		return []StorageBackend{backend}
+	}
+	backends := []StorageBackend{b.Default}
+	tenantIDs := make([]string, 0, len(b.Tenants))
+	for tenantID := range b.Tenants {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+	sort.Strings(tenantIDs)
+	for _, tenantID := range tenantIDs {
+		backends = append(backends, b.Tenants[tenantID])
+	}
+	return backends
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantConfigs(t *testing.T) {
+	var tenants tenantConfigs
+	parsed, err := tenants.Parse(map[string]interface{}{
+		"tenant-a": nil,
+		"tenant-b": map[string]interface{}{
+			"enabled":          false,
+			"bucket":           "b-bucket",
+			"dataobjectprefix": "b/",
+			"urlvalidduration": "10m",
+			"storagebackend":   "s3",
+			"maxuploadsize":    100,
+		},
+	})
+	require.Nil(t, err)
+	size := int64(100)
+	require.Equal(t, tenantConfigs{
+		"tenant-a": {Enabled: true},
+		"tenant-b": {
+			Bucket:           "b-bucket",
+			DataObjectPrefix: "b/",
+			URLValidDuration: 10 * time.Minute,
+			StorageBackend:   "s3",
+			MaxUploadSize:    &size,
+		},
+	}, parsed)
+
+	require.Nil(t, tenants.Set(`{"tenant-a": {"urlValidDuration": "1h", "maxUploadSize": 0, "deviceRate": 0.5}}`))
+	require.True(t, tenants["tenant-a"].Enabled)
+	require.Equal(t, 0.5, *tenants["tenant-a"].DeviceRate)
+	require.Equal(t, time.Hour, tenants["tenant-a"].URLValidDuration)
+	require.Equal(t, int64(0), *tenants["tenant-a"].MaxUploadSize)
+	require.Nil(t, tenants.Set(tenants.String()))
+	require.Equal(t, time.Hour, tenants["tenant-a"].URLValidDuration)
+
+	for _, value := range []string{
+		`tenant-a`,
+		`{"tenant-a": {"bucket": "a", "unknown": 1}}`,
+		`{"tenant-a": {"enabled": "maybe"}}`,
+		`{"tenant-a": {"maxUploadSize": "lots"}}`,
+		`{"tenant-a": "enabled"}`,
+		`{"tenant-a": null, "Tenant-A": null}`,
+	} {
+		require.Error(t, tenants.Set(value), value)
+	}
+	require.Error(t, tenantConfigs{"a": {MaxUploadSize: new(int64)}, "b": {StorageBackend: "ftp"}}.validate())
+
+	t.Run("check", func(t *testing.T) {
+		require.Nil(t, tenantConfigs{}.check("any"))
+		tenants := tenantConfigs{"enabled": {Enabled: true}, "disabled": {}}
+		require.Nil(t, tenants.check("enabled"))
+		require.ErrorIs(t, tenants.check("disabled"), errTenantDisabled)
+		require.ErrorIs(t, tenants.check("unknown"), errUnknownTenant)
+	})
+	t.Run("case", func(t *testing.T) {
+		// The configuration loader lowercases the keys of maps.
+		parsed, err := tenants.Parse(map[string]interface{}{"tenant-a": nil, "Tenant-B": nil})
+		require.Nil(t, err)
+		require.Equal(t, tenantConfigs{"tenant-a": {Enabled: true}, "tenant-b": {Enabled: true}}, parsed)
+		require.Nil(t, parsed.(tenantConfigs).check("Tenant-A"))
+		require.Nil(t, parsed.(tenantConfigs).check("tenant-b"))
+	})
+}
+
+func TestTenantBackend(t *testing.T) {
+	config := &configuration{
+		LocalDir:         t.TempDir(),
+		Host:             "http://localhost:9000",
+		URLValidDuration: 5 * time.Minute,
+		Bucket:           "bucket",
+		S3:               s3Config{Endpoint: "http://localhost:9001"},
+		Tenants: tenantConfigs{
+			"short":   {Enabled: true, URLValidDuration: time.Minute},
+			"s3":      {Enabled: true, StorageBackend: "s3", Bucket: "s3-bucket", DataObjectPrefix: "bags"},
+			"default": {Enabled: true},
+		},
+	}
+	backend, err := storageBackendFromConfig(config)
+	require.Nil(t, err)
+	require.IsType(t, &tenantBackend{}, backend)
+	require.Len(t, allStorage(backend), 3)
+
+	bg := context.Background()
+	u, err := backend.UploadURL(bg, "default", "device", "a.db3", uploadConstraints{})
+	require.Nil(t, err)
+	require.Equal(t, timeNow().Add(5*time.Minute), u.Expires)
+	u, err = backend.UploadURL(bg, "short", "device", "a.db3", uploadConstraints{})
+	require.Nil(t, err)
+	require.Equal(t, timeNow().Add(time.Minute), u.Expires)
+	u, err = backend.UploadURL(bg, "s3", "device", "a.db3", uploadConstraints{})
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(u.URL, "http://localhost:9001/s3-bucket/bags/s3/device/a.db3?"), u.URL)
+
+	// A generated signing key is shared so that the default backend accepts
+	// the URLs of every tenant.
+	defaultLocal := tenantStorage(backend, "default").(*localBackend)
+	require.Equal(t, defaultLocal.SigningKey, tenantStorage(backend, "short").(*localBackend).SigningKey)
+
+	config.Tenants = tenantConfigs{"default": {Enabled: true}}
+	backend, err = storageBackendFromConfig(config)
+	require.Nil(t, err)
+	require.IsType(t, &localBackend{}, backend)
+}
+
+func TestTenantUploadPolicy(t *testing.T) {
+	size := int64(5)
+	p := uploadPolicyFromConfig(&configuration{
+		Uploads: uploadConfig{MaxSize: 100, TenantMaxSizes: tenantSizes{"a": 10, "b": 20}},
+		Tenants: tenantConfigs{"a": {MaxUploadSize: &size}, "c": {}},
+	})
+	require.Equal(t, int64(5), p.maxSize("a"))
+	require.Equal(t, int64(20), p.maxSize("b"))
+	require.Equal(t, int64(100), p.maxSize("c"))
+
+	var sizes tenantSizes
+	require.Nil(t, sizes.Set("Tenant-A=10"))
+	p = uploadPolicyFromConfig(&configuration{
+		Uploads: uploadConfig{TenantMaxSizes: sizes},
+		Tenants: tenantConfigs{"tenant-b": {MaxUploadSize: &size}},
+	})
+	require.Equal(t, int64(10), p.maxSize("tenant-a"))
+	require.Equal(t, int64(5), p.maxSize("TENANT-B"))
+}
+
+func TestTenantTokenValidation(t *testing.T) {
+	gcp := testGCP()
+	registry := &countingRegistry{DeviceRegistry: gcp}
+	v := &tokenValidator{
+		Registry:        registry,
+		DefaultTenantID: "test-tenant",
+		Tenants:         tenantConfigs{"test-tenant": {Enabled: true}, "disabled": {}},
+	}
+	bg := context.Background()
+
+	_, err := v.Validate(bg, gcp.newTestToken("existing", "", "", nil))
+	require.Nil(t, err)
+	_, err = v.Validate(bg, gcp.newTestToken("existing", "test-tenant", "", nil))
+	require.Nil(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&registry.calls))
+	// The tenant ID is replaced with the configured one so that a tenant
+	// cannot use several storage paths or rate limit groups.
+	claims, err := v.Validate(bg, gcp.newTestToken("existing", "Test-Tenant", "", nil))
+	require.Nil(t, err)
+	require.Equal(t, "test-tenant", claims.TenantID)
+	require.Equal(t, int32(3), atomic.LoadInt32(&registry.calls))
+
+	// The jwt package does not wrap the errors returned by the key function.
+	_, err = v.Validate(bg, gcp.newTestToken("existing", "disabled", "", nil))
+	require.Contains(t, err.Error(), errTenantDisabled.Error())
+	_, err = v.Validate(bg, gcp.newTestToken("existing", "unknown", "", nil))
+	require.Contains(t, err.Error(), errUnknownTenant.Error())
+	require.Equal(t, int32(3), atomic.LoadInt32(&registry.calls))
+
+	t.Run("validation disabled", func(t *testing.T) {
+		config := &configuration{
+			DisableValidation: true,
+			DefaultTenantID:   "test-tenant",
+			Tenants:           v.Tenants,
+		}
+		readToken := deviceTokenReader(config, nil)
+		claims, err := readToken(bg, gcp.newTestToken("existing", "", "", nil))
+		require.Nil(t, err)
+		require.Equal(t, "test-tenant", claims.TenantID)
+		claims, err = readToken(bg, gcp.newTestToken("existing", "TEST-TENANT", "", nil))
+		require.Nil(t, err)
+		require.Equal(t, "test-tenant", claims.TenantID)
+		_, err = readToken(bg, gcp.newTestToken("existing", "unknown", "", nil))
+		require.ErrorIs(t, err, errUnknownTenant)
+	})
+}
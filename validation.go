@@ -2,44 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
-	"google.golang.org/api/cloudiot/v1"
 )
 
 // This is set to another function in tests to provide deterministic results.
 var timeNow = time.Now
 
-type gcpAPI interface {
-	GetDeviceCredentials(ctx context.Context, tenantID, deviceID string) ([]*cloudiot.DeviceCredential, error)
-}
-
-type gcpConfig struct {
-	ProjectID  string `config:"projectId"`
-	Region     string `config:"region"`
-	iotService *cloudiot.Service
-}
-
-func (g *gcpConfig) GetDeviceCredentials(
-	ctx context.Context,
-	tenantID string,
-	deviceID string,
-) ([]*cloudiot.DeviceCredential, error) {
-	device, err := g.iotService.Projects.Locations.Registries.Devices.Get(
-		fmt.Sprintf(
-			"projects/%s/locations/%s/registries/%s/devices/%s",
-			g.ProjectID, g.Region, tenantID, deviceID,
-		),
-	).Context(ctx).FieldMask("credentials").Do()
-	if err != nil {
-		return nil, err
-	}
-	return device.Credentials, nil
-}
-
 type invalidTokenError struct {
 	Err error
 }
@@ -51,23 +29,79 @@ func (err invalidTokenError) Error() string {
 	return "invalid token: " + err.Err.Error()
 }
 
+func (err invalidTokenError) Unwrap() error {
+	return err.Err
+}
+
 func parsePublicKey(
-	rawkey *cloudiot.PublicKeyCredential,
+	rawkey *publicKeyCredential,
 ) (key interface{}, alg string, err error) {
+	if rawkey == nil {
+		return nil, "", errors.New("public key is missing")
+	}
 	switch rawkey.Format {
 	case "RSA_X509_PEM":
 		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(rawkey.Key))
 		return key, "RS256", err
+	case "RS512_X509_PEM":
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(rawkey.Key))
+		return key, "RS512", err
 	case "ES256_X509_PEM":
-		key, err := jwt.ParseECPublicKeyFromPEM([]byte(rawkey.Key))
+		key, err := parseECPublicKey(rawkey.Key, elliptic.P256())
 		return key, "ES256", err
+	case "ES384_X509_PEM":
+		key, err := parseECPublicKey(rawkey.Key, elliptic.P384())
+		return key, "ES384", err
+	case "ED25519_X509_PEM":
+		key, err := parseEdPublicKey(rawkey.Key)
+		return key, "EdDSA", err
 	default:
 		return nil, "", errors.New("unsupported format: " + rawkey.Format)
 	}
 }
 
+// parseECPublicKey parses a PEM encoded certificate or public key and checks
+// that the key is on the given curve.
+func parseECPublicKey(rawkey string, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	key, err := jwt.ParseECPublicKeyFromPEM([]byte(rawkey))
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != curve {
+		return nil, fmt.Errorf("key is not on curve %s", curve.Params().Name)
+	}
+	return key, nil
+}
+
+// parseEdPublicKey parses a PEM encoded certificate or public key. Unlike
+// jwt.ParseEdPublicKeyFromPEM it also accepts certificates.
+func parseEdPublicKey(rawkey string) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode([]byte(rawkey))
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+	var parsed interface{}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		parsed = cert.PublicKey
+	} else {
+		var err error
+		if parsed, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, jwt.ErrNotEdPublicKey
+	}
+	return key, nil
+}
+
 func validateDeviceCredential(
-	cred *cloudiot.DeviceCredential,
+	cred *deviceCredential,
 	keyAlgorithm string,
 ) (pubKey interface{}, err error) {
 	expires, err := time.Parse(time.RFC3339, cred.ExpirationTime)
@@ -92,10 +126,118 @@ type jwtClaims struct {
 	DeviceID string `json:"deviceId"`
 	TenantID string `json:"tenantId"`
 	BagName  string `json:"bagName"`
+
+	// The following optional claims restrict what the device can upload.
+	ContentType   string `json:"contentType,omitempty"`
+	ContentMD5    string `json:"contentMD5,omitempty"`
+	ContentCRC32C string `json:"contentCRC32C,omitempty"`
+	ContentSHA256 string `json:"contentSHA256,omitempty"`
+	MaxSize       int64  `json:"maxSize,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
-func validateJWT(ctx context.Context, gcp gcpAPI, defaulTenantID, rawToken string) (*jwtClaims, error) {
+func (c *jwtClaims) uploadConstraints() uploadConstraints {
+	return uploadConstraints{
+		ContentType:   c.ContentType,
+		ContentMD5:    c.ContentMD5,
+		ContentCRC32C: c.ContentCRC32C,
+		ContentSHA256: c.ContentSHA256,
+		MaxSize:       c.MaxSize,
+	}
+}
+
+type tokenConfig struct {
+	// MaxLifetime is the maximum time between the issue and expiry times of a
+	// token. It is not limited if it is zero.
+	MaxLifetime time.Duration `config:"maxLifetime"`
+	// RequireJTI makes tokens without a jti claim invalid and rejects tokens
+	// whose ID has already been used by the same device.
+	RequireJTI bool `config:"requireJTI"`
+	// JTIStoreFile is a file where used token IDs are stored so that they are
+	// remembered after a restart. IDs are only kept in memory if it is empty.
+	JTIStoreFile string `config:"jtiStoreFile"`
+	// Audiences contains the accepted values of the aud claim. The claim is
+	// not checked if it is empty.
+	Audiences []string `config:"audiences"`
+	// Issuer is the expected value of the iss claim. The placeholders
+	// {tenantId} and {deviceId} are replaced with the IDs in the token. The
+	// claim is not checked if it is empty.
+	Issuer string `config:"issuer"`
+	// ClockSkew is the tolerance used when comparing exp, iat and nbf to the
+	// current time.
+	ClockSkew time.Duration `config:"clockSkew"`
+}
+
+// tokenValidator validates device JWTs against the credentials in a device
+// registry.
+type tokenValidator struct {
+	Registry        DeviceRegistry
+	DefaultTenantID string
+	MaxLifetime     time.Duration
+	Audiences       []string
+	Issuer          string
+	ClockSkew       time.Duration
+	// Nonces is used to reject replayed tokens. Token IDs are not checked if
+	// it is nil.
+	Nonces *nonceStore
+	// Tenants contains the tenants whose devices are accepted. Every tenant
+	// is accepted if it is empty.
+	Tenants tenantConfigs
+}
+
+func newTokenValidator(config *configuration, registry DeviceRegistry) (*tokenValidator, error) {
+	v := &tokenValidator{
+		Registry:        registry,
+		DefaultTenantID: config.DefaultTenantID,
+		MaxLifetime:     config.Tokens.MaxLifetime,
+		Audiences:       config.Tokens.Audiences,
+		Issuer:          config.Tokens.Issuer,
+		ClockSkew:       config.Tokens.ClockSkew,
+		Tenants:         config.Tenants,
+	}
+	if config.Tokens.RequireJTI {
+		if config.Tokens.JTIStoreFile == "" {
+			v.Nonces = newNonceStore()
+		} else {
+			var err error
+			if v.Nonces, err = openNonceStore(config.Tokens.JTIStoreFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func validateJWT(ctx context.Context, registry DeviceRegistry, defaulTenantID, rawToken string) (*jwtClaims, error) {
+	v := &tokenValidator{Registry: registry, DefaultTenantID: defaulTenantID}
+	return v.Validate(ctx, rawToken)
+}
+
+func (v *tokenValidator) verifyAudience(claims *jwtClaims) bool {
+	if len(v.Audiences) == 0 {
+		return true
+	}
+	for _, aud := range v.Audiences {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *tokenValidator) verifyIssuer(claims *jwtClaims) bool {
+	if v.Issuer == "" {
+		return true
+	}
+	expected := strings.NewReplacer(
+		"{tenantId}", claims.TenantID,
+		"{deviceId}", claims.DeviceID,
+	).Replace(v.Issuer)
+	return claims.Issuer == expected
+}
+
+func (v *tokenValidator) Validate(ctx context.Context, rawToken string) (*jwtClaims, error) {
 	// Automatic validation makes unit testing harder so it is skipped and
 	// manual validation is used instead.
 	parser := jwt.Parser{SkipClaimsValidation: true}
@@ -105,16 +247,40 @@ func validateJWT(ctx context.Context, gcp gcpAPI, defaulTenantID, rawToken strin
 		&claims,
 		func(t *jwt.Token) (interface{}, error) {
 			if claims.TenantID == "" {
-				claims.TenantID = defaulTenantID
+				claims.TenantID = v.DefaultTenantID
+			}
+			// Unknown tenants are rejected before the registry is queried
+			// for their devices.
+			if err := v.Tenants.check(claims.TenantID); err != nil {
+				return nil, invalidTokenError{err}
+			}
+			claims.TenantID = v.Tenants.resolve(claims.TenantID)
+			if err := checkDeviceIDs(claims.TenantID, claims.DeviceID); err != nil {
+				return nil, invalidTokenError{err}
 			}
 			now := timeNow()
-			if !claims.VerifyExpiresAt(now, true) {
+			if !claims.VerifyExpiresAt(now.Add(-v.ClockSkew), true) {
 				return nil, invalidTokenError{fmt.Errorf("expired at %v", claims.ExpiresAt)}
 			}
-			if !claims.VerifyIssuedAt(now, true) {
+			if !claims.VerifyIssuedAt(now.Add(v.ClockSkew), true) {
 				return nil, invalidTokenError{fmt.Errorf("invalid issue date: %v", claims.IssuedAt)}
 			}
-			creds, err := gcp.GetDeviceCredentials(ctx, claims.TenantID, claims.DeviceID)
+			if !claims.VerifyNotBefore(now.Add(v.ClockSkew), false) {
+				return nil, invalidTokenError{fmt.Errorf("not valid before %v", claims.NotBefore)}
+			}
+			if !v.verifyAudience(&claims) {
+				return nil, invalidTokenError{fmt.Errorf("invalid audience: %v", claims.Audience)}
+			}
+			if !v.verifyIssuer(&claims) {
+				return nil, invalidTokenError{fmt.Errorf("invalid issuer: %s", claims.Issuer)}
+			}
+			if v.MaxLifetime > 0 && claims.ExpiresAt.Sub(claims.IssuedAt.Time) > v.MaxLifetime {
+				return nil, invalidTokenError{fmt.Errorf("lifetime is longer than %v", v.MaxLifetime)}
+			}
+			if v.Nonces != nil && claims.ID == "" {
+				return nil, invalidTokenError{errors.New("jti claim is missing")}
+			}
+			creds, err := v.Registry.GetDeviceCredentials(ctx, claims.TenantID, claims.DeviceID)
 			if err != nil {
 				return nil, invalidTokenError{err}
 			}
@@ -135,6 +301,15 @@ func validateJWT(ctx context.Context, gcp gcpAPI, defaulTenantID, rawToken strin
 	if !token.Valid {
 		return nil, fmt.Errorf("failed to validate token: %w", err)
 	}
+	// The ID is recorded only after the signature has been verified so that
+	// forged tokens cannot use up the IDs of legitimate ones.
+	if v.Nonces != nil {
+		id := strings.Join([]string{claims.TenantID, claims.DeviceID, claims.ID}, "\x00")
+		// Tokens are accepted until ClockSkew after they have expired.
+		if err := v.Nonces.Use(id, claims.ExpiresAt.Time.Add(v.ClockSkew)); err != nil {
+			return nil, fmt.Errorf("failed to validate token: %w", invalidTokenError{err})
+		}
+	}
 	return &claims, nil
 }
 
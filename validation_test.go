@@ -2,14 +2,12 @@ package main
 
 import (
 	"context"
-	"errors"
 	"path"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
-	"google.golang.org/api/cloudiot/v1"
 )
 
 func TestValidateCredential(t *testing.T) {
@@ -17,14 +15,14 @@ func TestValidateCredential(t *testing.T) {
 		desc  string
 		alg   string
 		valid bool
-		cred  cloudiot.DeviceCredential
+		cred  deviceCredential
 	}{{
 		desc:  "valid RSA_X509_PEM",
 		alg:   "RS256",
 		valid: true,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "RSA_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
@@ -50,9 +48,9 @@ gZo=
 		desc:  "valid ES256_X509_PEM",
 		alg:   "ES256",
 		valid: true,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: timeNow().Add(3 * time.Hour).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "ES256_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIIBETCBuAIJAKdL4R/jQjJzMAoGCCqGSM49BAMCMBExDzANBgNVBAMMBnVudXNl
@@ -69,9 +67,9 @@ nbECIQCWeaUHLBAKxiRXiqfk+JNZvFrkKdFQFk77/x3ADrAjfw==
 		desc:  "invalid ES256_X509_PEM",
 		alg:   "ES256",
 		valid: false,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "ES256_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIIBETCBuAIJAKdL4R/jQjJzMAoGCCqGSM49BAMCMBExDzANBgNVBAMMBnVudXNl
@@ -88,9 +86,9 @@ nbECIQCWeaUHLBAKxiRXiqfk+JNZvFrkKdFQFk77/x3ADrAjfw==
 		desc:  "expired RSA_X509_PEM",
 		alg:   "RS256",
 		valid: false,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: timeNow().Add(-2 * time.Hour).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "RSA_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
@@ -116,9 +114,9 @@ gZo=
 		desc:  "mismatching algorithms",
 		alg:   "ES256",
 		valid: false,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "RSA_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
@@ -144,9 +142,9 @@ gZo=
 		desc:  "unsupported credential algorithm",
 		alg:   "RS256",
 		valid: false,
-		cred: cloudiot.DeviceCredential{
+		cred: deviceCredential{
 			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-			PublicKey: &cloudiot.PublicKeyCredential{
+			PublicKey: &publicKeyCredential{
 				Format: "ES256_X509_PEM",
 				Key: `-----BEGIN CERTIFICATE-----
 MIIBETCBuAIJAKdL4R/jQjJzMAoGCCqGSM49BAMCMBExDzANBgNVBAMMBnVudXNl
@@ -156,6 +154,209 @@ AkUpiVqDNuHsJvLoapJ7hAUmjG9C9lM4Wp6yF/6nHCaEmSBOkD/6Zde0AUB2zG4w
 CgYIKoZIzj0EAwIDSAAwRQIgQKJvL+i+23DrZqussgSc1XxEwfKCtt0tnhdtk2X0
 nbECIQCWeaUHLBAKxiRXiqfk+JNZvFrkKdFQFk77/x3ADrAjfw==
 -----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "valid RS512_X509_PEM",
+		alg:   "RS512",
+		valid: true,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "RS512_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
+bnVzZWQwHhcNMjEwMzI1MTQ1ODI1WhcNMjEwNDI0MTQ1ODI1WjARMQ8wDQYDVQQD
+DAZ1bnVzZWQwggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEKAoIBAQDRv5rVOBbD
+JuNKlR4JK9zW0+kn1W+/r7SnjzkWyv0/tJlFMmXHC65fSKgyZmE4sGWkfmUtJ0jT
+5uIWqX3EhZ9cinBeEeZQT2Q0jXGdB6d+V4ymcFfsHsRUaLOZJrJrUiQ4nPUPfScA
+lBgnMoDHefLwFiwbA+JOWWPT+kVfP2j0IkbmklhqW/gXJIYoRWd/kf0tJj/zBBFi
+TaNB/bZvAAIlLmN57jMwqMhocXnXuZlObYZzMeWLCVqN0lSzv4anrL9ggxHb0XNy
+zpmHXk+D5N/WNvNfvk23ibLQ6XJRPZGSKYH3YFeAFjBaNF7jkCjjG0JGRbAN4r0C
+TyYThDNzUP+7AgMBAAEwDQYJKoZIhvcNAQELBQADggEBACaTOWVouFxoAy4AQ+j0
+9VZiiEeNDCtFDviW+n+zMfc14WNsKJ3Iejgd2FKicK/MAQr+GLEGc34MXHnisKkZ
+wWDbaiGQ7/MzVT7PkKAc/iawQCobBm6tSvv7Ajd3a7wEM82v7iBWTph1msJpdsS5
+bw7T8/WUGGTTLcOJacgoHB607KDtU4hp+5vqhkm02BLyWxMGxMjOtgKbtIo/6i6Y
+pAgY1r/cpJX1CMUxrEtUQjWK2hN+wIh5xpk9+SW39xEBlLmWRpqtQqvDGZ9rQESC
+LcGHp2ydpEaGPe8Ue2zu0gAbz9j8dvPXbafrrGoVenR13RjXc0TqKo9733BKfNsB
+gZo=
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "RS512_X509_PEM used with RS256",
+		alg:   "RS256",
+		valid: false,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "RS512_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
+bnVzZWQwHhcNMjEwMzI1MTQ1ODI1WhcNMjEwNDI0MTQ1ODI1WjARMQ8wDQYDVQQD
+DAZ1bnVzZWQwggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEKAoIBAQDRv5rVOBbD
+JuNKlR4JK9zW0+kn1W+/r7SnjzkWyv0/tJlFMmXHC65fSKgyZmE4sGWkfmUtJ0jT
+5uIWqX3EhZ9cinBeEeZQT2Q0jXGdB6d+V4ymcFfsHsRUaLOZJrJrUiQ4nPUPfScA
+lBgnMoDHefLwFiwbA+JOWWPT+kVfP2j0IkbmklhqW/gXJIYoRWd/kf0tJj/zBBFi
+TaNB/bZvAAIlLmN57jMwqMhocXnXuZlObYZzMeWLCVqN0lSzv4anrL9ggxHb0XNy
+zpmHXk+D5N/WNvNfvk23ibLQ6XJRPZGSKYH3YFeAFjBaNF7jkCjjG0JGRbAN4r0C
+TyYThDNzUP+7AgMBAAEwDQYJKoZIhvcNAQELBQADggEBACaTOWVouFxoAy4AQ+j0
+9VZiiEeNDCtFDviW+n+zMfc14WNsKJ3Iejgd2FKicK/MAQr+GLEGc34MXHnisKkZ
+wWDbaiGQ7/MzVT7PkKAc/iawQCobBm6tSvv7Ajd3a7wEM82v7iBWTph1msJpdsS5
+bw7T8/WUGGTTLcOJacgoHB607KDtU4hp+5vqhkm02BLyWxMGxMjOtgKbtIo/6i6Y
+pAgY1r/cpJX1CMUxrEtUQjWK2hN+wIh5xpk9+SW39xEBlLmWRpqtQqvDGZ9rQESC
+LcGHp2ydpEaGPe8Ue2zu0gAbz9j8dvPXbafrrGoVenR13RjXc0TqKo9733BKfNsB
+gZo=
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "valid ES384_X509_PEM",
+		alg:   "ES384",
+		valid: true,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ES384_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIIBtTCCATqgAwIBAgIUbFafrmSgFvPdQJmjvfL0qqUqnmAwCgYIKoZIzj0EAwMw
+ETEPMA0GA1UEAwwGdW51c2VkMB4XDTI2MTAxNjA0Mzc1NVoXDTI2MTExNTA0Mzc1
+NVowETEPMA0GA1UEAwwGdW51c2VkMHYwEAYHKoZIzj0CAQYFK4EEACIDYgAET6ye
+AjFcjj6KoZ7guY5QHFtf4swg2qQgexSNlRgOvLG+1NMvc29Hli3C/fsy9ZrbQUim
+OoS4v6Pkkg81/Rz//4VEMuJCmR3Dp4oD8zpUH9PFjC68J5+v4Xz6Wrv/LuZeo1Mw
+UTAdBgNVHQ4EFgQUMC3XRBns6QCv+XtuHumLu1D57R4wHwYDVR0jBBgwFoAUMC3X
+RBns6QCv+XtuHumLu1D57R4wDwYDVR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAwNp
+ADBmAjEAjcfIlHfEJfSg8q2PmZIdjY+uNF7mBOawFn2FEOTrR9z6u29K21ZsuILM
+dimoTCpeAjEAuB/8c0kTd71Euy7nn49A/U1SaLUvsFYuLG1pxuWQti+SrQtdYUpY
+sTl5LS9TgwUl
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "P-256 key as ES384_X509_PEM",
+		alg:   "ES384",
+		valid: false,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ES384_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIIBETCBuAIJAKdL4R/jQjJzMAoGCCqGSM49BAMCMBExDzANBgNVBAMMBnVudXNl
+ZDAeFw0yMTAzMjYwODA1MjhaFw0yMTA0MjUwODA1MjhaMBExDzANBgNVBAMMBnVu
+dXNlZDBZMBMGByqGSM49AgEGCCqGSM49AwEHA0IABCfIe3oJBIO692y2fg13dMPo
+AkUpiVqDNuHsJvLoapJ7hAUmjG9C9lM4Wp6yF/6nHCaEmSBOkD/6Zde0AUB2zG4w
+CgYIKoZIzj0EAwIDSAAwRQIgQKJvL+i+23DrZqussgSc1XxEwfKCtt0tnhdtk2X0
+nbECIQCWeaUHLBAKxiRXiqfk+JNZvFrkKdFQFk77/x3ADrAjfw==
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "P-384 key as ES256_X509_PEM",
+		alg:   "ES256",
+		valid: false,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ES256_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIIBtTCCATqgAwIBAgIUbFafrmSgFvPdQJmjvfL0qqUqnmAwCgYIKoZIzj0EAwMw
+ETEPMA0GA1UEAwwGdW51c2VkMB4XDTI2MTAxNjA0Mzc1NVoXDTI2MTExNTA0Mzc1
+NVowETEPMA0GA1UEAwwGdW51c2VkMHYwEAYHKoZIzj0CAQYFK4EEACIDYgAET6ye
+AjFcjj6KoZ7guY5QHFtf4swg2qQgexSNlRgOvLG+1NMvc29Hli3C/fsy9ZrbQUim
+OoS4v6Pkkg81/Rz//4VEMuJCmR3Dp4oD8zpUH9PFjC68J5+v4Xz6Wrv/LuZeo1Mw
+UTAdBgNVHQ4EFgQUMC3XRBns6QCv+XtuHumLu1D57R4wHwYDVR0jBBgwFoAUMC3X
+RBns6QCv+XtuHumLu1D57R4wDwYDVR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAwNp
+ADBmAjEAjcfIlHfEJfSg8q2PmZIdjY+uNF7mBOawFn2FEOTrR9z6u29K21ZsuILM
+dimoTCpeAjEAuB/8c0kTd71Euy7nn49A/U1SaLUvsFYuLG1pxuWQti+SrQtdYUpY
+sTl5LS9TgwUl
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "valid ED25519_X509_PEM certificate",
+		alg:   "EdDSA",
+		valid: true,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ED25519_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIIBNjCB6aADAgECAhRjb78vZfcx0Ay1xGX4QfS3sGDb8jAFBgMrZXAwETEPMA0G
+A1UEAwwGdW51c2VkMB4XDTI2MTAxNjA0Mzc1NVoXDTI2MTExNTA0Mzc1NVowETEP
+MA0GA1UEAwwGdW51c2VkMCowBQYDK2VwAyEAEa1WbLoCeOKXL1E53FSYLrtNFncH
+hKo1Mj8zx2KafwmjUzBRMB0GA1UdDgQWBBTSmgKY7ec7AZfrEVsH0LTS9hjm+zAf
+BgNVHSMEGDAWgBTSmgKY7ec7AZfrEVsH0LTS9hjm+zAPBgNVHRMBAf8EBTADAQH/
+MAUGAytlcANBAPEbCwgzGcJOmwbmO5eHh2/cg98S7dL3/MoyI3HVltrjTOTk0RRs
+D1DhVi5RbAGkOB/OJftxHFilLtejlP1/NAE=
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "valid ED25519_X509_PEM public key",
+		alg:   "EdDSA",
+		valid: true,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ED25519_X509_PEM",
+				Key: `-----BEGIN PUBLIC KEY-----
+MCowBQYDK2VwAyEAEa1WbLoCeOKXL1E53FSYLrtNFncHhKo1Mj8zx2Kafwk=
+-----END PUBLIC KEY-----
+`,
+			},
+		},
+	}, {
+		desc:  "ED25519_X509_PEM used with ES256",
+		alg:   "ES256",
+		valid: false,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ED25519_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIIBNjCB6aADAgECAhRjb78vZfcx0Ay1xGX4QfS3sGDb8jAFBgMrZXAwETEPMA0G
+A1UEAwwGdW51c2VkMB4XDTI2MTAxNjA0Mzc1NVoXDTI2MTExNTA0Mzc1NVowETEP
+MA0GA1UEAwwGdW51c2VkMCowBQYDK2VwAyEAEa1WbLoCeOKXL1E53FSYLrtNFncH
+hKo1Mj8zx2KafwmjUzBRMB0GA1UdDgQWBBTSmgKY7ec7AZfrEVsH0LTS9hjm+zAf
+BgNVHSMEGDAWgBTSmgKY7ec7AZfrEVsH0LTS9hjm+zAPBgNVHRMBAf8EBTADAQH/
+MAUGAytlcANBAPEbCwgzGcJOmwbmO5eHh2/cg98S7dL3/MoyI3HVltrjTOTk0RRs
+D1DhVi5RbAGkOB/OJftxHFilLtejlP1/NAE=
+-----END CERTIFICATE-----
+`,
+			},
+		},
+	}, {
+		desc:  "RSA key as ED25519_X509_PEM",
+		alg:   "EdDSA",
+		valid: false,
+		cred: deviceCredential{
+			ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
+			PublicKey: &publicKeyCredential{
+				Format: "ED25519_X509_PEM",
+				Key: `-----BEGIN CERTIFICATE-----
+MIICnjCCAYYCCQDNlT9aSLGSlDANBgkqhkiG9w0BAQsFADARMQ8wDQYDVQQDDAZ1
+bnVzZWQwHhcNMjEwMzI1MTQ1ODI1WhcNMjEwNDI0MTQ1ODI1WjARMQ8wDQYDVQQD
+DAZ1bnVzZWQwggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEKAoIBAQDRv5rVOBbD
+JuNKlR4JK9zW0+kn1W+/r7SnjzkWyv0/tJlFMmXHC65fSKgyZmE4sGWkfmUtJ0jT
+5uIWqX3EhZ9cinBeEeZQT2Q0jXGdB6d+V4ymcFfsHsRUaLOZJrJrUiQ4nPUPfScA
+lBgnMoDHefLwFiwbA+JOWWPT+kVfP2j0IkbmklhqW/gXJIYoRWd/kf0tJj/zBBFi
+TaNB/bZvAAIlLmN57jMwqMhocXnXuZlObYZzMeWLCVqN0lSzv4anrL9ggxHb0XNy
+zpmHXk+D5N/WNvNfvk23ibLQ6XJRPZGSKYH3YFeAFjBaNF7jkCjjG0JGRbAN4r0C
+TyYThDNzUP+7AgMBAAEwDQYJKoZIhvcNAQELBQADggEBACaTOWVouFxoAy4AQ+j0
+9VZiiEeNDCtFDviW+n+zMfc14WNsKJ3Iejgd2FKicK/MAQr+GLEGc34MXHnisKkZ
+wWDbaiGQ7/MzVT7PkKAc/iawQCobBm6tSvv7Ajd3a7wEM82v7iBWTph1msJpdsS5
+bw7T8/WUGGTTLcOJacgoHB607KDtU4hp+5vqhkm02BLyWxMGxMjOtgKbtIo/6i6Y
+pAgY1r/cpJX1CMUxrEtUQjWK2hN+wIh5xpk9+SW39xEBlLmWRpqtQqvDGZ9rQESC
+LcGHp2ydpEaGPe8Ue2zu0gAbz9j8dvPXbafrrGoVenR13RjXc0TqKo9733BKfNsB
+gZo=
+-----END CERTIFICATE-----
 `,
 			},
 		},
@@ -175,19 +376,18 @@ nbECIQCWeaUHLBAKxiRXiqfk+JNZvFrkKdFQFk77/x3ADrAjfw==
 type gcpConfigTest struct {
 	rawPrivateKey []byte
 	privateKey    interface{}
-	credentials   map[string][]*cloudiot.DeviceCredential
+	credentials   map[string][]*deviceCredential
 }
 
-func (c *gcpConfigTest) GetDeviceCredentials(ctx context.Context, tenantID, deviceID string) ([]*cloudiot.DeviceCredential, error) {
+func (c *gcpConfigTest) GetDeviceCredentials(ctx context.Context, tenantID, deviceID string) ([]*deviceCredential, error) {
 	creds, ok := c.credentials[path.Join(tenantID, deviceID)]
 	if ok {
 		return creds, nil
 	}
-	return nil, errors.New("unknown device: " + deviceID)
+	return nil, unknownDeviceError{tenantID, deviceID}
 }
 
 func (c *gcpConfigTest) newTestToken(id, tenant, name string, expires *time.Time) string {
-	signingMethod := jwt.GetSigningMethod("RS256")
 	if tenant == "" {
 		tenant = "test-tenant"
 	}
@@ -219,7 +419,11 @@ func (c *gcpConfigTest) newTestToken(id, tenant, name string, expires *time.Time
 			RegisteredClaims: registeredClaims,
 		}
 	}
-	token := jwt.NewWithClaims(signingMethod, claims)
+	return c.signTestClaims(claims)
+}
+
+func (c *gcpConfigTest) signTestClaims(claims jwt.Claims) string {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims)
 	s, err := token.SignedString(c.privateKey)
 	if err != nil {
 		panic(err)
@@ -305,11 +509,11 @@ v1aXtd+Hg5fu=
 	return &gcpConfigTest{
 		privateKey:    privateKey,
 		rawPrivateKey: rawPrivateKey,
-		credentials: map[string][]*cloudiot.DeviceCredential{
+		credentials: map[string][]*deviceCredential{
 			"test-tenant/existing": {
 				{
 					ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-					PublicKey: &cloudiot.PublicKeyCredential{
+					PublicKey: &publicKeyCredential{
 						Format: "RSA_X509_PEM",
 						Key:    publicKey,
 					},
@@ -318,7 +522,7 @@ v1aXtd+Hg5fu=
 			"test-tenant/another existing": {
 				{
 					ExpirationTime: time.Unix(0, 0).Format(time.RFC3339),
-					PublicKey: &cloudiot.PublicKeyCredential{
+					PublicKey: &publicKeyCredential{
 						Format: "RSA_X509_PEM",
 						Key:    publicKeyWithoutPrivateKey,
 					},
@@ -368,6 +572,121 @@ func TestValidateJWT(t *testing.T) {
 		}
 		assert.Nil(t, claims)
 	})
+	t.Run("replayed token", func(t *testing.T) {
+		v := &tokenValidator{Registry: gcp, DefaultTenantID: "test-tenant", Nonces: newNonceStore()}
+		newTokenWithID := func(id string) string {
+			return gcp.signTestClaims(&jwtClaims{
+				DeviceID: "existing",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ID:        id,
+					ExpiresAt: jwt.NewNumericDate(timeNow().Add(time.Minute)),
+					IssuedAt:  jwt.NewNumericDate(timeNow()),
+				},
+			})
+		}
+		_, err := v.Validate(bg, newToken("existing", nil))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "jti claim is missing")
+		}
+		token := newTokenWithID("1")
+		_, err = v.Validate(bg, token)
+		assert.NoError(t, err)
+		_, err = v.Validate(bg, token)
+		assert.ErrorIs(t, err, errTokenReplayed)
+		_, err = v.Validate(bg, newTokenWithID("2"))
+		assert.NoError(t, err)
+
+		// Expired tokens are accepted within the clock skew, so their IDs
+		// are remembered until it has passed.
+		v.ClockSkew = 30 * time.Second
+		token = newTokenWithID("3")
+		_, err = v.Validate(bg, token)
+		assert.NoError(t, err)
+		defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+		now := timeNow().Add(time.Minute + 10*time.Second)
+		timeNow = func() time.Time { return now }
+		_, err = v.Validate(bg, token)
+		assert.ErrorIs(t, err, errTokenReplayed)
+	})
+	t.Run("too long lifetime", func(t *testing.T) {
+		v := &tokenValidator{Registry: gcp, DefaultTenantID: "test-tenant", MaxLifetime: 2 * time.Minute}
+		_, err := v.Validate(bg, newToken("existing", nil))
+		assert.NoError(t, err)
+		expires := timeNow().Add(2 * time.Minute)
+		_, err = v.Validate(bg, newToken("existing", &expires))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "lifetime")
+		}
+	})
+	t.Run("registered claims", func(t *testing.T) {
+		v := &tokenValidator{
+			Registry:        gcp,
+			DefaultTenantID: "test-tenant",
+			Audiences:       []string{"mission-data-recorder-backend", "other"},
+			Issuer:          "devices/{tenantId}/{deviceId}",
+			ClockSkew:       30 * time.Second,
+		}
+		validClaims := func() *jwtClaims {
+			return &jwtClaims{
+				DeviceID: "existing",
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    "devices/test-tenant/existing",
+					Audience:  jwt.ClaimStrings{"mission-data-recorder-backend"},
+					ExpiresAt: jwt.NewNumericDate(timeNow().Add(time.Minute)),
+					IssuedAt:  jwt.NewNumericDate(timeNow()),
+				},
+			}
+		}
+		testCases := []struct {
+			desc   string
+			modify func(c *jwtClaims)
+			reason string
+		}{
+			{"valid", func(c *jwtClaims) {}, ""},
+			{"another audience", func(c *jwtClaims) { c.Audience = jwt.ClaimStrings{"x", "other"} }, ""},
+			{"wrong audience", func(c *jwtClaims) { c.Audience = jwt.ClaimStrings{"x"} }, "invalid audience"},
+			{"missing audience", func(c *jwtClaims) { c.Audience = nil }, "invalid audience"},
+			{"wrong issuer", func(c *jwtClaims) { c.Issuer = "devices/test-tenant/another" }, "invalid issuer"},
+			{"missing issuer", func(c *jwtClaims) { c.Issuer = "" }, "invalid issuer"},
+			{
+				"not before within skew",
+				func(c *jwtClaims) { c.NotBefore = jwt.NewNumericDate(timeNow().Add(20 * time.Second)) },
+				"",
+			},
+			{
+				"not yet valid",
+				func(c *jwtClaims) { c.NotBefore = jwt.NewNumericDate(timeNow().Add(time.Minute)) },
+				"not valid before",
+			},
+			{
+				"expired within skew",
+				func(c *jwtClaims) { c.ExpiresAt = jwt.NewNumericDate(timeNow().Add(-20 * time.Second)) },
+				"",
+			},
+			{
+				"expired beyond skew",
+				func(c *jwtClaims) { c.ExpiresAt = jwt.NewNumericDate(timeNow().Add(-time.Minute)) },
+				"expired",
+			},
+			{
+				"issued in the future within skew",
+				func(c *jwtClaims) { c.IssuedAt = jwt.NewNumericDate(timeNow().Add(20 * time.Second)) },
+				"",
+			},
+		}
+		for _, tC := range testCases {
+			t.Run(tC.desc, func(t *testing.T) {
+				claims := validClaims()
+				tC.modify(claims)
+				_, err := v.Validate(bg, gcp.signTestClaims(claims))
+				if tC.reason == "" {
+					assert.NoError(t, err)
+				} else if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tC.reason)
+				}
+			})
+		}
+	})
 	t.Run("empty bag name", func(t *testing.T) {
 		claims, err := validateJWT(bg, gcp, "test-tenant", gcp.newTestToken("existing", "", "", nil))
 		assert.Nil(t, err)